@@ -1,22 +1,42 @@
 package api
 
 import (
+	"encoding/csv"
 	"encoding/json"
+	"errors"
 	"io"
 	"mqtt2http/lib"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
 )
 
 type Controller struct {
-	server   *mqtt.Server
-	store    *lib.ClientStore
-	password string
+	server    *mqtt.Server
+	store     *lib.ClientStore
+	authCache *lib.AuthCache
+	limiter   *lib.ConnectLimiter
+	bans      *lib.BanList
+	topics    *lib.TopicStats
+	password  string
+	mutex     sync.RWMutex
 }
 
-func NewController(server *mqtt.Server, store *lib.ClientStore, password string) *Controller {
-	return &Controller{server: server, store: store, password: password}
+func NewController(server *mqtt.Server, store *lib.ClientStore, authCache *lib.AuthCache, limiter *lib.ConnectLimiter, bans *lib.BanList, topics *lib.TopicStats, password string) *Controller {
+	return &Controller{server: server, store: store, authCache: authCache, limiter: limiter, bans: bans, topics: topics, password: password}
+}
+
+func (c *Controller) SetPassword(password string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.password = password
 }
 
 func (c *Controller) RootHandler() http.HandlerFunc {
@@ -29,7 +49,11 @@ func (c *Controller) RootHandler() http.HandlerFunc {
 
 func (c *Controller) withAuthentication(next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		if c.password != "" {
+		c.mutex.RLock()
+		expected := c.password
+		c.mutex.RUnlock()
+
+		if expected != "" {
 			_, password, ok := r.BasicAuth()
 
 			if !ok {
@@ -38,7 +62,7 @@ func (c *Controller) withAuthentication(next http.HandlerFunc) http.HandlerFunc
 				return
 			}
 
-			if password != c.password {
+			if password != expected {
 				w.WriteHeader(http.StatusForbidden)
 				io.WriteString(w, "Forbidden")
 				return
@@ -71,9 +95,212 @@ func (c *Controller) PublishHandler() http.HandlerFunc {
 	})
 }
 
+// Output formats of the clients.
+const (
+	formatJSON   = "json"
+	formatNDJSON = "ndjson"
+	formatCSV    = "csv"
+)
+
+// DumpHandler streams the records of the connected clients selected by the
+// query parameters, as a JSON array, NDJSON or CSV. The cursor of the next
+// page is returned in the X-Next-Cursor header.
 func (c *Controller) DumpHandler() http.HandlerFunc {
 	return c.withAuthentication(func(w http.ResponseWriter, r *http.Request) {
-		data, err := c.store.Export()
+		query, err := parseClientQuery(r.URL.Query())
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			io.WriteString(w, err.Error())
+			return
+		}
+
+		format := r.URL.Query().Get("format")
+		switch format {
+		case "", formatJSON, formatNDJSON, formatCSV:
+		default:
+			w.WriteHeader(http.StatusBadRequest)
+			io.WriteString(w, "Unknown format")
+			return
+		}
+
+		clients, next, err := c.store.Query(query)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			io.WriteString(w, err.Error())
+			return
+		}
+		if next != "" {
+			w.Header().Set("X-Next-Cursor", next)
+		}
+
+		switch format {
+		case formatNDJSON:
+			w.Header().Set("Content-Type", "application/x-ndjson")
+			encoder := json.NewEncoder(w)
+			for _, client := range clients {
+				encoder.Encode(client)
+			}
+		case formatCSV:
+			w.Header().Set("Content-Type", "text/csv")
+			writeClientsCSV(w, clients)
+		default:
+			w.Header().Set("Content-Type", "application/json")
+			io.WriteString(w, "[")
+			for i, client := range clients {
+				if i > 0 {
+					io.WriteString(w, ",")
+				}
+				data, _ := json.Marshal(client)
+				w.Write(data)
+			}
+			io.WriteString(w, "]")
+		}
+	})
+}
+
+// parseClientQuery reads the filters, sort order and page of the clients.
+// inactive_since takes a duration or an RFC 3339 time, and a sort order
+// starting with - is descending.
+func parseClientQuery(values url.Values) (lib.ClientQuery, error) {
+	query := lib.ClientQuery{
+		Username:     values.Get("username"),
+		IDPrefix:     values.Get("client_id_prefix"),
+		Subscription: values.Get("subscription"),
+		Listener:     values.Get("listener"),
+		Cursor:       values.Get("cursor"),
+	}
+	query.Sort, query.Descending = strings.CutPrefix(values.Get("sort"), "-")
+
+	if value := values.Get("inactive_since"); value != "" {
+		if duration, err := time.ParseDuration(value); err == nil {
+			query.InactiveSince = time.Now().Add(-duration)
+		} else if query.InactiveSince, err = time.Parse(time.RFC3339, value); err != nil {
+			return query, errors.New("invalid inactive_since")
+		}
+	}
+	if value := values.Get("limit"); value != "" {
+		limit, err := strconv.Atoi(value)
+		if err != nil {
+			return query, errors.New("invalid limit")
+		}
+		query.Limit = limit
+	}
+	return query, query.Validate()
+}
+
+func writeClientsCSV(w io.Writer, clients []*lib.Client) {
+	writer := csv.NewWriter(w)
+	writer.Write([]string{"id", "username", "listener", "remote_addr", "connected_at", "last_activity_at", "subscriptions", "publications"})
+	for _, client := range clients {
+		var publications int64
+		for _, count := range client.Publications {
+			publications += count
+		}
+		filters := []string{}
+		for _, sub := range client.Subscribtions {
+			filters = append(filters, sub.Filter)
+		}
+		writer.Write([]string{
+			client.ID,
+			client.Username,
+			client.Listener,
+			client.RemoteAddr,
+			client.ConnectedAt.UTC().Format(time.RFC3339),
+			client.LastActivityAt.UTC().Format(time.RFC3339),
+			strings.Join(filters, " "),
+			strconv.FormatInt(publications, 10),
+		})
+	}
+	writer.Flush()
+}
+
+// SubscriptionsHandler lists the subscriptions receiving the topics of the
+// filter query parameter, or all of them.
+func (c *Controller) SubscriptionsHandler() http.HandlerFunc {
+	return c.withAuthentication(func(w http.ResponseWriter, r *http.Request) {
+		subs := lib.Subscriptions(c.server, r.URL.Query().Get("filter"))
+		data, _ := json.Marshal(subs)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(data)
+	})
+}
+
+// TopicsHandler lists the activity of the topics matching the filter query
+// parameter, or of all of them.
+func (c *Controller) TopicsHandler() http.HandlerFunc {
+	return c.withAuthentication(func(w http.ResponseWriter, r *http.Request) {
+		topics := c.topics.Topics(c.server.Topics, r.URL.Query().Get("filter"))
+		data, _ := json.Marshal(topics)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(data)
+	})
+}
+
+func (c *Controller) FlushAuthCacheHandler() http.HandlerFunc {
+	return c.withAuthentication(func(w http.ResponseWriter, r *http.Request) {
+		flushed := 0
+		if c.authCache != nil {
+			flushed = c.authCache.Flush()
+		}
+
+		c.server.Log.Info("Flush auth cache", "entries", flushed)
+		data, _ := json.Marshal(map[string]int{"flushed": flushed})
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(data)
+	})
+}
+
+func (c *Controller) LockoutsHandler() http.HandlerFunc {
+	return c.withAuthentication(func(w http.ResponseWriter, r *http.Request) {
+		lockouts := []lib.Lockout{}
+		if c.limiter != nil {
+			lockouts = c.limiter.Lockouts()
+		}
+
+		data, _ := json.Marshal(lockouts)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(data)
+	})
+}
+
+// ClearLockoutsHandler lifts the lockouts, optionally only those matching
+// the kind and key query parameters.
+func (c *Controller) ClearLockoutsHandler() http.HandlerFunc {
+	return c.withAuthentication(func(w http.ResponseWriter, r *http.Request) {
+		kind := r.URL.Query().Get("kind")
+		key := r.URL.Query().Get("key")
+		if kind != "" && kind != lib.LimitIP && kind != lib.LimitUsername {
+			w.WriteHeader(http.StatusBadRequest)
+			io.WriteString(w, "Unknown kind")
+			return
+		}
+
+		cleared := 0
+		if c.limiter != nil {
+			cleared = c.limiter.Clear(kind, key)
+		}
+
+		c.server.Log.Info("Clear lockouts", "kind", kind, "key", key, "cleared", cleared)
+		data, _ := json.Marshal(map[string]int{"cleared": cleared})
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(data)
+	})
+}
+
+// ClientHandler returns the record of a client merged with the live state
+// of its MQTT session.
+func (c *Controller) ClientHandler() http.HandlerFunc {
+	return c.withAuthentication(func(w http.ResponseWriter, r *http.Request) {
+		id := r.PathValue("id")
+		cl, ok := c.server.Clients.Get(id)
+		if !ok || cl.Net.Inline {
+			w.WriteHeader(http.StatusNotFound)
+			io.WriteString(w, "Client not found")
+			return
+		}
+
+		record, _ := c.store.Snapshot(id)
+		data, err := json.Marshal(lib.NewClientDetails(record, cl))
 		if err != nil {
 			w.WriteHeader(http.StatusInternalServerError)
 			io.WriteString(w, "failed to export")
@@ -83,3 +310,297 @@ func (c *Controller) DumpHandler() http.HandlerFunc {
 		w.Write(data)
 	})
 }
+
+// KickHandler disconnects a client. MQTT 5 clients get the reason code and
+// reason string of the code and reason query parameters, administrative
+// action by default.
+func (c *Controller) KickHandler() http.HandlerFunc {
+	return c.withAuthentication(func(w http.ResponseWriter, r *http.Request) {
+		id := r.PathValue("id")
+		cl, ok := c.server.Clients.Get(id)
+		if !ok || cl.Net.Inline || cl.Closed() {
+			w.WriteHeader(http.StatusNotFound)
+			io.WriteString(w, "Client not connected")
+			return
+		}
+
+		code := packets.ErrAdministrativeAction
+		if value := r.URL.Query().Get("code"); value != "" {
+			parsed, err := strconv.ParseUint(value, 0, 8)
+			if err != nil || parsed != 0 && parsed < 0x80 {
+				w.WriteHeader(http.StatusBadRequest)
+				io.WriteString(w, "Invalid reason code")
+				return
+			}
+			code = packets.Code{Code: byte(parsed)}
+		}
+		if reason := r.URL.Query().Get("reason"); reason != "" {
+			code.Reason = reason
+		}
+
+		c.server.Log.Info("Kick client", "client", id, "code", code.Code, "reason", code.Reason)
+		lib.Disconnect(c.server, cl, code)
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+func (c *Controller) BansHandler() http.HandlerFunc {
+	return c.withAuthentication(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := json.Marshal(c.bans.List())
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(data)
+	})
+}
+
+type banRequest struct {
+	Kind     string `json:"kind"`
+	Value    string `json:"value"`
+	Reason   string `json:"reason"`
+	Duration string `json:"duration"`
+}
+
+// BanHandler bans a username, client ID or IP address or CIDR, for the
+// duration when given, and disconnects the connected clients it applies to.
+func (c *Controller) BanHandler() http.HandlerFunc {
+	return c.withAuthentication(func(w http.ResponseWriter, r *http.Request) {
+		var request banRequest
+		err := json.NewDecoder(r.Body).Decode(&request)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			io.WriteString(w, "Invalid ban: "+err.Error())
+			return
+		}
+
+		ban := lib.Ban{Kind: request.Kind, Value: request.Value, Reason: request.Reason, CreatedAt: time.Now().UTC()}
+		if request.Duration != "" {
+			duration, err := time.ParseDuration(request.Duration)
+			if err != nil || duration <= 0 {
+				w.WriteHeader(http.StatusBadRequest)
+				io.WriteString(w, "Invalid duration")
+				return
+			}
+			expiresAt := ban.CreatedAt.Add(duration)
+			ban.ExpiresAt = &expiresAt
+		}
+		err = ban.Parse()
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			io.WriteString(w, "Invalid ban: "+err.Error())
+			return
+		}
+
+		err = c.bans.Add(ban)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			io.WriteString(w, err.Error())
+			return
+		}
+		c.server.Log.Info("Ban", "kind", ban.Kind, "value", ban.Value, "reason", ban.Reason, "duration", request.Duration)
+
+		code := packets.ErrBanned
+		if ban.Reason != "" {
+			code.Reason = ban.Reason
+		}
+		for _, cl := range c.server.Clients.GetAll() {
+			if cl.Net.Inline || cl.Closed() || !ban.Matches(cl.ID, string(cl.Properties.Username), cl.Net.Remote) {
+				continue
+			}
+			c.server.Log.Info("Disconnecting banned client", "client", cl.ID, "kind", ban.Kind, "value", ban.Value)
+			lib.Disconnect(c.server, cl, code)
+		}
+
+		data, _ := json.Marshal(ban)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		w.Write(data)
+	})
+}
+
+// UnbanHandler lifts the ban with the kind and value query parameters.
+func (c *Controller) UnbanHandler() http.HandlerFunc {
+	return c.withAuthentication(func(w http.ResponseWriter, r *http.Request) {
+		kind := r.URL.Query().Get("kind")
+		value := r.URL.Query().Get("value")
+		if kind == "" || value == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			io.WriteString(w, "Missing kind or value")
+			return
+		}
+
+		removed, err := c.bans.Remove(kind, value)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			io.WriteString(w, err.Error())
+			return
+		}
+		if !removed {
+			w.WriteHeader(http.StatusNotFound)
+			io.WriteString(w, "Ban not found")
+			return
+		}
+
+		c.server.Log.Info("Lift ban", "kind", kind, "value", value)
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+// audit logs a change made through the API, with the user and the address
+// that requested it.
+func (c *Controller) audit(r *http.Request, msg string, args ...any) {
+	user, _, _ := r.BasicAuth()
+	c.server.Log.Info(msg, append([]any{"audit", true, "user", user, "remote_addr", r.RemoteAddr}, args...)...)
+}
+
+func (c *Controller) RetainedHandler() http.HandlerFunc {
+	return c.withAuthentication(func(w http.ResponseWriter, r *http.Request) {
+		filter := r.URL.Query().Get("filter")
+		if filter == "" {
+			filter = "#"
+		}
+		if !mqtt.IsValidFilter(filter, false) {
+			w.WriteHeader(http.StatusBadRequest)
+			io.WriteString(w, "Invalid filter")
+			return
+		}
+
+		data, _ := json.Marshal(lib.NewRetainedMessages(c.server.Topics.Messages(filter)))
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(data)
+	})
+}
+
+func (c *Controller) RetainedMessageHandler() http.HandlerFunc {
+	return c.withAuthentication(func(w http.ResponseWriter, r *http.Request) {
+		pk, ok := c.server.Topics.Retained.Get(r.PathValue("topic"))
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			io.WriteString(w, "Retained message not found")
+			return
+		}
+
+		data, _ := json.Marshal(lib.NewRetainedMessage(pk))
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(data)
+	})
+}
+
+// SetRetainedHandler retains the body as the message of a topic and
+// publishes it to the subscribers. The QoS, message expiry and user
+// properties are read from the query, the content type from the header.
+func (c *Controller) SetRetainedHandler() http.HandlerFunc {
+	return c.withAuthentication(func(w http.ResponseWriter, r *http.Request) {
+		topic := r.PathValue("topic")
+		if !mqtt.IsValidFilter(topic, true) {
+			w.WriteHeader(http.StatusBadRequest)
+			io.WriteString(w, "Invalid topic")
+			return
+		}
+
+		pk, err := parseRetainedPacket(topic, r)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			io.WriteString(w, err.Error())
+			return
+		}
+
+		defer r.Body.Close()
+		pk.Payload, err = io.ReadAll(r.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			io.WriteString(w, err.Error())
+			return
+		}
+		if len(pk.Payload) == 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			io.WriteString(w, "Empty payload, delete the retained message instead")
+			return
+		}
+
+		inline, ok := c.server.Clients.Get(mqtt.InlineClientId)
+		if !ok {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			io.WriteString(w, "Inline client not available")
+			return
+		}
+		if err := c.server.InjectPacket(inline, pk); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			io.WriteString(w, err.Error())
+			return
+		}
+
+		c.audit(r, "Set retained message", "topic", topic, "qos", pk.FixedHeader.Qos)
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+func parseRetainedPacket(topic string, r *http.Request) (packets.Packet, error) {
+	values := r.URL.Query()
+	pk := packets.Packet{
+		FixedHeader: packets.FixedHeader{Type: packets.Publish, Retain: true},
+		TopicName:   topic,
+	}
+	pk.Properties.ContentType = r.Header.Get("Content-Type")
+
+	if value := values.Get("qos"); value != "" {
+		qos, err := strconv.ParseUint(value, 10, 8)
+		if err != nil || qos > 2 {
+			return pk, errors.New("Invalid qos")
+		}
+		pk.FixedHeader.Qos = byte(qos)
+		// A packet ID is needed to pass the validity checks of the broker.
+		pk.PacketID = uint16(qos)
+	}
+	if value := values.Get("message_expiry"); value != "" {
+		expiry, err := strconv.ParseUint(value, 10, 32)
+		if err != nil {
+			return pk, errors.New("Invalid message_expiry")
+		}
+		pk.Properties.MessageExpiryInterval = uint32(expiry)
+	}
+	for _, property := range values["user_property"] {
+		key, value, ok := strings.Cut(property, "=")
+		if !ok || key == "" {
+			return pk, errors.New("Invalid user_property, expected key=value")
+		}
+		pk.Properties.User = append(pk.Properties.User, packets.UserProperty{Key: key, Val: value})
+	}
+	return pk, nil
+}
+
+func (c *Controller) DeleteRetainedMessageHandler() http.HandlerFunc {
+	return c.withAuthentication(func(w http.ResponseWriter, r *http.Request) {
+		topic := r.PathValue("topic")
+		if !lib.DeleteRetained(c.server, topic) {
+			w.WriteHeader(http.StatusNotFound)
+			io.WriteString(w, "Retained message not found")
+			return
+		}
+
+		c.audit(r, "Delete retained message", "topic", topic)
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+// DeleteRetainedHandler deletes the retained messages matched by the filter.
+// The filter is required, # deletes them all.
+func (c *Controller) DeleteRetainedHandler() http.HandlerFunc {
+	return c.withAuthentication(func(w http.ResponseWriter, r *http.Request) {
+		filter := r.URL.Query().Get("filter")
+		if filter == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			io.WriteString(w, "Missing filter")
+			return
+		}
+		if !mqtt.IsValidFilter(filter, false) {
+			w.WriteHeader(http.StatusBadRequest)
+			io.WriteString(w, "Invalid filter")
+			return
+		}
+
+		topics := lib.DeleteRetainedMatching(c.server, filter)
+		c.audit(r, "Delete retained messages", "filter", filter, "topics", topics)
+		data, _ := json.Marshal(map[string]any{"deleted": len(topics), "topics": topics})
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(data)
+	})
+}
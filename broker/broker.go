@@ -1,6 +1,7 @@
 package broker
 
 import (
+	"crypto/tls"
 	"fmt"
 	"mqtt2http/api"
 	"mqtt2http/hooks"
@@ -9,18 +10,32 @@ import (
 	"time"
 
 	mqtt "github.com/mochi-mqtt/server/v2"
-	"github.com/mochi-mqtt/server/v2/listeners"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
+// fileCheckInterval is how often the TLS, JWKS, users and revocation
+// files are checked for changes.
+const fileCheckInterval = 10 * time.Second
+
 type Broker struct {
-	config *BrokerConfig
-	server *mqtt.Server
+	config       *BrokerConfig
+	server       *mqtt.Server
+	httpClient   *lib.HTTPClient
+	aclClient    *lib.ACLClient
+	sessionHook  *hooks.SessionHook
+	publishHook  *hooks.PublishHook
+	controller   *api.Controller
+	certificates *lib.CertificateLoader
+	jwt          *lib.JWTVerifier
+	users        *lib.UserFile
+	revoked      *lib.RevocationList
+	bans         *lib.BanList
+	stop         chan struct{}
 }
 
 func NewBroker(config *BrokerConfig) *Broker {
-	broker := &Broker{config: config}
+	broker := &Broker{config: config, stop: make(chan struct{})}
 
 	// Create the new MQTT Server.
 	options := &mqtt.Options{
@@ -37,15 +52,25 @@ func (b *Broker) Start(reg prometheus.Registerer) error {
 	metrics := lib.NewMetrics(reg)
 
 	// Create HTTP Client
-	httpClient := lib.NewHTTPClient(
+	b.httpClient = lib.NewHTTPClient(
 		b.config.ContentType,
 		b.config.TopicHeader,
 		b.config.AuthorizeURL,
+		b.config.AuthorizeFormat,
 		metrics,
 	)
+	if b.config.AuthCacheTTL > 0 || b.config.AuthNegativeTTL > 0 {
+		b.httpClient.Cache, err = lib.NewAuthCache(b.config.AuthCacheTTL, b.config.AuthNegativeTTL, metrics)
+		if err != nil {
+			return err
+		}
+	}
 
 	// Create the client store
 	clientStore := lib.NewClientStore(metrics)
+	clientStore.MaxSessions = b.config.MaxSessions
+	clientStore.SessionPolicy = b.config.SessionPolicy
+	clientStore.Takeover = b.config.ClientIDTakeover
 
 	// Setup lifecycle hook
 	lifecycleHook := &hooks.LifecycleHook{}
@@ -54,45 +79,148 @@ func (b *Broker) Start(reg prometheus.Registerer) error {
 		return fmt.Errorf("failed to add lifecycle hook: %w", err)
 	}
 
+	// Create the ACL client when an ACL endpoint is configured
+	if b.config.ACLURL != "" {
+		b.aclClient = lib.NewACLClient(b.config.ACLURL, b.config.ACLCacheTTL, metrics)
+	}
+
+	// Verify JWT passwords locally when a key set is configured
+	if b.config.JWTEnabled() {
+		b.jwt, err = b.config.jwtVerifier()
+		if err != nil {
+			return fmt.Errorf("failed to load JWKS: %w", err)
+		}
+		interval := b.config.JWKSRefresh
+		if b.config.JWKSFile != "" {
+			interval = fileCheckInterval
+		}
+		go b.jwt.Keys.Watch(interval, b.stop)
+	}
+
+	// Authenticate the users of the users file locally
+	if b.config.UsersFilePath != "" {
+		b.users, err = lib.NewUserFile(b.config.UsersFilePath)
+		if err != nil {
+			return fmt.Errorf("failed to load users: %w", err)
+		}
+		go b.users.Watch(fileCheckInterval, b.stop)
+	}
+
+	// Chain the authenticators
+	err = b.config.validateAuthenticators()
+	if err != nil {
+		return err
+	}
+	policy := b.config.AuthFailurePolicy
+	if policy == "" {
+		policy = lib.AuthFailClosed
+	}
+	authChain, err := lib.NewAuthChain(policy, b.config.AuthKnownTTL)
+	if err != nil {
+		return err
+	}
+	for _, name := range b.config.AuthenticatorNames() {
+		switch name {
+		case lib.AuthenticatorHTTP:
+			authChain.Add(name, &lib.HTTPAuthenticator{Client: b.httpClient})
+		case lib.AuthenticatorFile:
+			authChain.Add(name, b.users)
+		case lib.AuthenticatorJWT:
+			authChain.Add(name, b.jwt)
+		case lib.AuthenticatorClientCert:
+			if b.config.CertRevokedFile != "" {
+				b.revoked, err = lib.NewRevocationList(b.config.CertRevokedFile)
+				if err != nil {
+					return fmt.Errorf("failed to load revoked certificates: %w", err)
+				}
+				go b.revoked.Watch(fileCheckInterval, b.stop)
+			}
+			authChain.Add(name, &lib.ClientCertAuthenticator{UsernameTemplate: b.config.certUsernameTemplate(), Revoked: b.revoked})
+		case lib.AuthenticatorAnonymous:
+			authChain.Add(name, &lib.AnonymousAuthenticator{})
+		}
+	}
+
+	// Limit connect attempts and lock out clients failing to authenticate
+	limiter := b.config.connectLimiter(metrics)
+
+	// Refuse banned clients
+	b.bans, err = lib.NewBanList(b.config.BansFilePath)
+	if err != nil {
+		return fmt.Errorf("failed to load bans: %w", err)
+	}
+
 	// Setup connect-authenticate, acl, disconnect  hook
-	authHook := &hooks.SessionHook{HTTPClient: httpClient, Store: clientStore}
-	err = b.server.AddHook(authHook, nil)
+	b.sessionHook = &hooks.SessionHook{Server: b.server, Auth: authChain, Limiter: limiter, Bans: b.bans, ACL: b.aclClient, ACLRules: b.config.ACLRules, Store: clientStore}
+	err = b.server.AddHook(b.sessionHook, nil)
 	if err != nil {
 		return fmt.Errorf("failed to add auth hook: %w", err)
 	}
 
 	// Setup publish hook
-	publishHook := &hooks.PublishHook{HTTPClient: httpClient, Routes: b.config.Routes, Store: clientStore}
-	err = b.server.AddHook(publishHook, nil)
+	topicStats := lib.NewTopicStats()
+	b.publishHook = &hooks.PublishHook{HTTPClient: b.httpClient, Routes: b.config.Routes, Store: clientStore, Topics: topicStats}
+	err = b.server.AddHook(b.publishHook, nil)
 	if err != nil {
 		return fmt.Errorf("failed to add publish hook: %w", err)
 	}
 
-	// Create a TCP listener on a standard port.
-	options := listeners.Config{ID: "t1", Address: b.config.TCPAddr}
-	tcp := listeners.NewTCP(options)
-	err = b.server.AddListener(tcp)
+	// Load the certificate shared by the TLS and secure websocket listeners.
+	var tlsConfig *tls.Config
+	if b.config.HasCertificate() {
+		b.certificates, tlsConfig, err = b.config.tlsConfig()
+		if err != nil {
+			return fmt.Errorf("failed to configure TLS: %w", err)
+		}
+		go b.certificates.Watch(fileCheckInterval, b.stop)
+	}
+
+	// Create the listeners
+	listenerConfigs := b.config.ListenerConfigs()
+	err = validateListeners(listenerConfigs, tlsConfig != nil)
 	if err != nil {
-		return fmt.Errorf("failed to add TCP listener: %w", err)
+		return err
+	}
+	for _, config := range listenerConfigs {
+		err = b.server.AddListener(newListener(config, tlsConfig))
+		if err != nil {
+			return fmt.Errorf("failed to add %s listener %q: %w", config.Type, config.Name, err)
+		}
+		b.server.Log.Info("Added listener", "name", config.Name, "type", config.Type, "addr", config.Address)
 	}
 
 	// Start
-	b.server.Log.Info("Starting MQTT server", "addr", b.config.TCPAddr)
+	b.server.Log.Info("Starting MQTT server", "listeners", len(listenerConfigs))
 	err = b.server.Serve()
 	if err != nil {
 		return fmt.Errorf("failed to start server: %w", err)
 	}
 
 	// HTTP server
+	b.controller = api.NewController(b.server, clientStore, b.httpClient.Cache, limiter, b.bans, topicStats, b.config.APIPassword)
+
 	go func() {
 		b.server.Log.Info("Starting API HTTP server", "addr", b.config.HTTPAddr)
 
-		controller := api.NewController(b.server, clientStore, b.config.APIPassword)
-
 		mux := http.NewServeMux()
-		mux.HandleFunc("/", controller.RootHandler())
-		mux.HandleFunc("/publish", controller.PublishHandler())
-		mux.HandleFunc("/clients", controller.DumpHandler())
+		mux.HandleFunc("/", b.controller.RootHandler())
+		mux.HandleFunc("/publish", b.controller.PublishHandler())
+		mux.HandleFunc("/clients", b.controller.DumpHandler())
+		mux.HandleFunc("GET /clients/{id}", b.controller.ClientHandler())
+		mux.HandleFunc("DELETE /clients/{id}", b.controller.KickHandler())
+		mux.HandleFunc("GET /subscriptions", b.controller.SubscriptionsHandler())
+		mux.HandleFunc("GET /topics", b.controller.TopicsHandler())
+		mux.HandleFunc("GET /retained", b.controller.RetainedHandler())
+		mux.HandleFunc("DELETE /retained", b.controller.DeleteRetainedHandler())
+		mux.HandleFunc("GET /retained/{topic...}", b.controller.RetainedMessageHandler())
+		mux.HandleFunc("PUT /retained/{topic...}", b.controller.SetRetainedHandler())
+		mux.HandleFunc("DELETE /retained/{topic...}", b.controller.DeleteRetainedMessageHandler())
+		mux.HandleFunc("GET /bans", b.controller.BansHandler())
+		mux.HandleFunc("POST /bans", b.controller.BanHandler())
+		mux.HandleFunc("DELETE /bans", b.controller.UnbanHandler())
+		mux.HandleFunc("DELETE /auth/cache", b.controller.FlushAuthCacheHandler())
+		mux.HandleFunc("GET /lockouts", b.controller.LockoutsHandler())
+		mux.HandleFunc("DELETE /lockouts", b.controller.ClearLockoutsHandler())
 
 		err := http.ListenAndServe(b.config.HTTPAddr, mux)
 		if err != nil {
@@ -116,7 +244,56 @@ func (b *Broker) Start(reg prometheus.Registerer) error {
 	return nil
 }
 
+// Reload reads the configuration files and secrets again and applies them
+// to the running broker.
+func (b *Broker) Reload() {
+	b.server.Log.Info("Reloading configuration")
+	b.config.Load()
+
+	b.httpClient.SetAuthorizeURL(b.config.AuthorizeURL)
+	if b.aclClient != nil {
+		b.aclClient.SetURL(b.config.ACLURL)
+	}
+	b.sessionHook.SetACLRules(b.config.ACLRules)
+	b.publishHook.SetRoutes(b.config.Routes)
+	b.controller.SetPassword(b.config.APIPassword)
+
+	if b.certificates != nil {
+		err := b.certificates.Reload()
+		if err != nil {
+			b.server.Log.Error("Failed to reload certificates", "err", err)
+		}
+	}
+
+	if b.jwt != nil {
+		err := b.jwt.Keys.Reload()
+		if err != nil {
+			b.server.Log.Error("Failed to reload JWKS", "err", err)
+		}
+	}
+
+	if b.users != nil {
+		err := b.users.Reload()
+		if err != nil {
+			b.server.Log.Error("Failed to reload users", "err", err)
+		}
+	}
+
+	if b.revoked != nil {
+		err := b.revoked.Reload()
+		if err != nil {
+			b.server.Log.Error("Failed to reload revoked certificates", "err", err)
+		}
+	}
+
+	err := b.bans.Reload()
+	if err != nil {
+		b.server.Log.Error("Failed to reload bans", "err", err)
+	}
+}
+
 func (b *Broker) Close() {
+	close(b.stop)
 	closed := make(chan bool)
 
 	go func() {
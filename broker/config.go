@@ -1,34 +1,117 @@
 package broker
 
 import (
+	"crypto/tls"
+	"errors"
+	"fmt"
 	"io"
 	"log/slog"
 	"mqtt2http/lib"
 	"os"
+	"regexp"
+	"strings"
+	"time"
 
 	"github.com/goccy/go-yaml"
 )
 
+// interpolationPattern matches ${VAR} references inside the routes file.
+var interpolationPattern = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
 type BrokerConfig struct {
-	TCPAddr         string
-	HTTPAddr        string
-	AuthorizeURL    string
-	PublishURL      string
-	ContentType     string
-	TopicHeader     string
-	MetricsHTTPAddr string
-	RoutesFilePath  string
-	APIPassword     string
-	Routes          []lib.Route
+	TCPAddr           string
+	HTTPAddr          string
+	AuthorizeURL      string
+	AuthorizeURLFile  string
+	AuthorizeFormat   string
+	AuthCacheTTL      time.Duration
+	AuthNegativeTTL   time.Duration
+	JWKSFile          string
+	JWKSURL           string
+	JWKSRefresh       time.Duration
+	JWTIssuer         string
+	JWTAudience       string
+	JWTUsernameClaim  string
+	JWTPermissions    string
+	UsersFilePath     string
+	Authenticators    []string
+	AuthFailurePolicy string
+	AuthKnownTTL      time.Duration
+	CertUsername      string
+	CertRevokedFile   string
+	ConnectRateIP     float64
+	ConnectBurstIP    int
+	ConnectRateUser   float64
+	ConnectBurstUser  int
+	AuthMaxFailures   int
+	AuthLockout       time.Duration
+	AuthMaxLockout    time.Duration
+	MaxSessions       int
+	SessionPolicy     string
+	ClientIDTakeover  string
+	BansFilePath      string
+	PublishURL        string
+	PublishURLFile    string
+	ContentType       string
+	TopicHeader       string
+	MetricsHTTPAddr   string
+	RoutesFilePath    string
+	APIPassword       string
+	APIPasswordFile   string
+	ACLURL            string
+	ACLURLFile        string
+	ACLCacheTTL       time.Duration
+	ACLFilePath       string
+	ACLRules          *lib.ACLRules
+	TLSAddr           string
+	TLSCertFile       string
+	TLSKeyFile        string
+	TLSClientCAFile   string
+	TLSClientAuth     string
+	TLSMinVersion     string
+	TLSCipherSuites   string
+	WSAddr            string
+	WSPath            string
+	WSAllowedOrigins  []string
+	WSTLS             bool
+	ProxyProtocol     bool
+	ProxyTrustedCIDRs []string
+	ListenersFilePath string
+	Listeners         []ListenerConfig
+	Routes            []lib.Route
+
+	defaultRoute bool
 }
 
 func (c *BrokerConfig) Load() {
-	err := c.loadRoutes()
+	err := c.loadSecrets()
+	if err != nil {
+		slog.Error("Failed to load secrets", "err", err)
+	}
+
+	if len(c.Listeners) == 0 {
+		listeners, err := c.loadListeners()
+		if err == nil {
+			c.Listeners = listeners
+		}
+	}
+
+	aclRules, err := c.loadACLRules()
+	if err != nil {
+		slog.Info("No ACL rules loaded", "err", err)
+	} else {
+		c.ACLRules = aclRules
+	}
+
+	routes, err := c.loadRoutes()
 	if err != nil {
 		slog.Info("No routes loaded", "err", err)
+	} else {
+		c.Routes = routes
+		c.defaultRoute = false
 	}
 
-	if len(c.Routes) == 0 && c.PublishURL != "" {
+	if (len(c.Routes) == 0 || c.defaultRoute) && c.PublishURL != "" {
 		slog.Info("Adding default route", "url", c.PublishURL)
 		c.Routes = []lib.Route{
 			{
@@ -37,27 +120,389 @@ func (c *BrokerConfig) Load() {
 				URL:     c.PublishURL,
 			},
 		}
+		c.defaultRoute = true
+	}
+}
+
+// Validate checks that the secret files can be read and that the routes
+// file, when present, parses and only contains valid patterns.
+func (c *BrokerConfig) Validate() error {
+	err := c.loadSecrets()
+	if err != nil {
+		return err
+	}
+
+	routes := c.Routes
+	if _, err := os.Stat(c.RoutesFilePath); err == nil {
+		routes, err = c.loadRoutes()
+		if err != nil {
+			return fmt.Errorf("invalid routes file: %w", err)
+		}
+	}
+
+	for _, route := range routes {
+		_, err := regexp.Compile(route.Pattern)
+		if err != nil {
+			return fmt.Errorf("invalid pattern for route %q: %w", route.Name, err)
+		}
+		for _, username := range route.Usernames {
+			_, err := regexp.Compile(username)
+			if err != nil {
+				return fmt.Errorf("invalid username pattern for route %q: %w", route.Name, err)
+			}
+		}
+	}
+
+	switch c.AuthorizeFormat {
+	case "", lib.AuthorizeFormatBasic, lib.AuthorizeFormatJSON, lib.AuthorizeFormatHeaders:
+	default:
+		return fmt.Errorf("unknown authorize format %q", c.AuthorizeFormat)
+	}
+
+	if c.JWKSFile != "" && c.JWKSURL != "" {
+		return errors.New("JWKS file and URL are mutually exclusive")
+	}
+	if c.JWKSFile != "" {
+		_, err := lib.NewJWKS(c.JWKSFile, "")
+		if err != nil {
+			return err
+		}
+	}
+
+	if c.UsersFilePath != "" {
+		_, err := lib.NewUserFile(c.UsersFilePath)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = c.validateAuthenticators()
+	if err != nil {
+		return err
+	}
+
+	if c.ConnectRateIP < 0 || c.ConnectRateUser < 0 {
+		return errors.New("connect rates must not be negative")
+	}
+	if c.AuthMaxFailures < 0 {
+		return errors.New("auth max failures must not be negative")
+	}
+	if c.AuthMaxFailures > 0 && c.AuthLockout <= 0 {
+		return errors.New("auth lockout must be positive when auth max failures is set")
+	}
+
+	if c.MaxSessions < 0 {
+		return errors.New("max sessions must not be negative")
+	}
+	switch c.SessionPolicy {
+	case "", lib.SessionLimitRejectNew, lib.SessionLimitKickOldest:
+	default:
+		return fmt.Errorf("unknown session limit policy %q", c.SessionPolicy)
+	}
+	switch c.ClientIDTakeover {
+	case "", lib.TakeoverAllow, lib.TakeoverSameUsername, lib.TakeoverReject:
+	default:
+		return fmt.Errorf("unknown client ID takeover policy %q", c.ClientIDTakeover)
+	}
+
+	_, err = lib.NewBanList(c.BansFilePath)
+	if err != nil {
+		return err
+	}
+
+	if _, err := os.Stat(c.ACLFilePath); err == nil {
+		_, err = c.loadACLRules()
+		if err != nil {
+			return fmt.Errorf("invalid ACL file: %w", err)
+		}
+	}
+
+	if c.HasCertificate() {
+		_, _, err := c.tlsConfig()
+		if err != nil {
+			return err
+		}
+	}
+
+	configs := c.ListenerConfigs()
+	if _, err := os.Stat(c.ListenersFilePath); err == nil {
+		configs, err = c.loadListeners()
+		if err != nil {
+			return fmt.Errorf("invalid listeners file: %w", err)
+		}
+	}
+	err = validateListeners(configs, c.HasCertificate())
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// connectLimiter returns the limiter of connect attempts, or nil when
+// neither rate limits nor lockouts are configured.
+func (c *BrokerConfig) connectLimiter(metrics *lib.Metrics) *lib.ConnectLimiter {
+	if c.ConnectRateIP <= 0 && c.ConnectRateUser <= 0 && c.AuthMaxFailures <= 0 {
+		return nil
+	}
+
+	limiter := lib.NewConnectLimiter(metrics)
+	limiter.IPRate = c.ConnectRateIP
+	limiter.IPBurst = c.ConnectBurstIP
+	limiter.UsernameRate = c.ConnectRateUser
+	limiter.UsernameBurst = c.ConnectBurstUser
+	limiter.MaxFailures = c.AuthMaxFailures
+	limiter.Lockout = c.AuthLockout
+	limiter.MaxLockout = c.AuthMaxLockout
+	return limiter
+}
+
+// HasCertificate reports whether a TLS certificate and key are configured.
+func (c *BrokerConfig) HasCertificate() bool {
+	return c.TLSCertFile != "" && c.TLSKeyFile != ""
+}
+
+// AuthenticatorNames returns the configured chain of authenticators. By
+// default, JWTs and the users file are checked when configured, before the
+// authorize endpoint.
+func (c *BrokerConfig) AuthenticatorNames() []string {
+	if len(c.Authenticators) > 0 {
+		return c.Authenticators
+	}
+
+	names := []string{}
+	if c.JWTEnabled() {
+		names = append(names, lib.AuthenticatorJWT)
+	}
+	if c.UsersFilePath != "" {
+		names = append(names, lib.AuthenticatorFile)
+	}
+	return append(names, lib.AuthenticatorHTTP)
+}
+
+func (c *BrokerConfig) validateAuthenticators() error {
+	seen := make(map[string]bool)
+	for _, name := range c.AuthenticatorNames() {
+		switch name {
+		case lib.AuthenticatorHTTP, lib.AuthenticatorAnonymous:
+		case lib.AuthenticatorJWT:
+			if !c.JWTEnabled() {
+				return errors.New("jwt authenticator requires a JWKS file or URL")
+			}
+		case lib.AuthenticatorFile:
+			if c.UsersFilePath == "" {
+				return errors.New("file authenticator requires a users file")
+			}
+		case lib.AuthenticatorClientCert:
+			if c.TLSClientCAFile == "" {
+				return errors.New("client-cert authenticator requires a client CA file")
+			}
+			err := lib.ValidateCertTemplate(c.certUsernameTemplate())
+			if err != nil {
+				return fmt.Errorf("invalid certificate username template: %w", err)
+			}
+			if c.CertRevokedFile != "" {
+				_, err := lib.NewRevocationList(c.CertRevokedFile)
+				if err != nil {
+					return err
+				}
+			}
+		default:
+			return fmt.Errorf("unknown authenticator %q", name)
+		}
+		if seen[name] {
+			return fmt.Errorf("duplicate authenticator %q", name)
+		}
+		seen[name] = true
+	}
+
+	switch c.AuthFailurePolicy {
+	case "", lib.AuthFailClosed, lib.AuthFailOpen, lib.AuthFailKnown:
+	default:
+		return fmt.Errorf("unknown auth failure policy %q", c.AuthFailurePolicy)
+	}
+	return nil
+}
+
+func (c *BrokerConfig) certUsernameTemplate() string {
+	if c.CertUsername == "" {
+		return "{cn}"
+	}
+	return c.CertUsername
+}
+
+// JWTEnabled reports whether JWTs are verified locally.
+func (c *BrokerConfig) JWTEnabled() bool {
+	return c.JWKSFile != "" || c.JWKSURL != ""
+}
+
+// jwtVerifier loads the JWKS and builds the JWT verifier.
+func (c *BrokerConfig) jwtVerifier() (*lib.JWTVerifier, error) {
+	keys, err := lib.NewJWKS(c.JWKSFile, c.JWKSURL)
+	if err != nil {
+		return nil, err
+	}
+
+	usernameClaim := c.JWTUsernameClaim
+	if usernameClaim == "" {
+		usernameClaim = "sub"
+	}
+
+	return &lib.JWTVerifier{
+		Keys:             keys,
+		Issuer:           c.JWTIssuer,
+		Audience:         c.JWTAudience,
+		UsernameClaim:    usernameClaim,
+		PermissionsClaim: c.JWTPermissions,
+	}, nil
+}
+
+// TLSEnabled reports whether the MQTTS listener should be started.
+func (c *BrokerConfig) TLSEnabled() bool {
+	return c.TLSAddr != "" && c.HasCertificate()
+}
+
+// tlsConfig loads the certificates and builds the MQTTS listener settings.
+func (c *BrokerConfig) tlsConfig() (*lib.CertificateLoader, *tls.Config, error) {
+	minVersion, err := lib.ParseTLSVersion(c.TLSMinVersion)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	cipherSuites, err := lib.ParseCipherSuites(c.TLSCipherSuites)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	clientAuth := c.TLSClientAuth
+	if clientAuth == "" && c.TLSClientCAFile != "" {
+		clientAuth = "require"
+	}
+	clientAuthType, err := lib.ParseClientAuth(clientAuth)
+	if err != nil {
+		return nil, nil, err
+	}
+	if clientAuthType != tls.NoClientCert && c.TLSClientCAFile == "" {
+		return nil, nil, fmt.Errorf("client auth mode %q requires a client CA file", clientAuth)
+	}
+
+	loader, err := lib.NewCertificateLoader(c.TLSCertFile, c.TLSKeyFile, c.TLSClientCAFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	return loader, loader.TLSConfig(minVersion, cipherSuites, clientAuthType), nil
+}
+
+// loadSecrets replaces secret-bearing settings with the content of their
+// companion file, when one is configured.
+func (c *BrokerConfig) loadSecrets() error {
+	secrets := []struct {
+		value *string
+		path  string
+	}{
+		{&c.AuthorizeURL, c.AuthorizeURLFile},
+		{&c.PublishURL, c.PublishURLFile},
+		{&c.APIPassword, c.APIPasswordFile},
+		{&c.ACLURL, c.ACLURLFile},
+	}
+
+	for _, secret := range secrets {
+		if secret.path == "" {
+			continue
+		}
+		value, err := readSecretFile(secret.path)
+		if err != nil {
+			return err
+		}
+		*secret.value = value
 	}
+
+	return nil
 }
 
-func (c *BrokerConfig) loadRoutes() error {
+func (c *BrokerConfig) loadRoutes() ([]lib.Route, error) {
 	routesFile, err := os.Open(c.RoutesFilePath)
 	if err != nil {
 		slog.Info("Failed to open routes file", "err", err)
-		return err
+		return nil, err
 	}
+	defer routesFile.Close()
 
 	routesData, err := io.ReadAll(routesFile)
 	if err != nil {
 		slog.Error("Failed to read routes file", "err", err)
-		return err
+		return nil, err
 	}
 
-	err = yaml.Unmarshal(routesData, &c.Routes)
+	routes := []lib.Route{}
+	err = yaml.Unmarshal(routesData, &routes)
 	if err != nil {
 		slog.Error("Failed to parse routes", "err", err)
-		return err
+		return nil, err
 	}
 
-	return nil
+	for i := range routes {
+		err = routes[i].Interpolate(interpolate)
+		if err != nil {
+			slog.Error("Failed to interpolate route", "err", err, "name", routes[i].Name)
+			return nil, err
+		}
+	}
+
+	return routes, nil
+}
+
+func (c *BrokerConfig) loadACLRules() (*lib.ACLRules, error) {
+	aclData, err := os.ReadFile(c.ACLFilePath)
+	if err != nil {
+		slog.Info("Failed to open ACL file", "err", err)
+		return nil, err
+	}
+
+	rules := &lib.ACLRules{}
+	err = yaml.Unmarshal(aclData, rules)
+	if err != nil {
+		slog.Error("Failed to parse ACL rules", "err", err)
+		return nil, err
+	}
+
+	err = rules.Compile()
+	if err != nil {
+		slog.Error("Invalid ACL rules", "err", err)
+		return nil, err
+	}
+
+	return rules, nil
+}
+
+// interpolate expands ${VAR} references using the environment. When VAR is
+// not set, the content of the file named by VAR_FILE is used instead.
+func interpolate(value string) (string, error) {
+	var err error
+
+	result := interpolationPattern.ReplaceAllStringFunc(value, func(match string) string {
+		name := interpolationPattern.FindStringSubmatch(match)[1]
+		if v, ok := os.LookupEnv(name); ok {
+			return v
+		}
+		if path, ok := os.LookupEnv(name + "_FILE"); ok {
+			v, readErr := readSecretFile(path)
+			if readErr != nil {
+				err = readErr
+			}
+			return v
+		}
+		err = fmt.Errorf("variable %s is not defined", name)
+		return match
+	})
+
+	return result, err
+}
+
+func readSecretFile(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read secret file: %w", err)
+	}
+	return strings.TrimRight(string(data), "\r\n"), nil
 }
@@ -0,0 +1,172 @@
+package broker
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io"
+	"log/slog"
+	"mqtt2http/lib"
+	"net"
+	"os"
+
+	"github.com/goccy/go-yaml"
+	"github.com/mochi-mqtt/server/v2/listeners"
+)
+
+const (
+	ListenerTCP       = "tcp"
+	ListenerTLS       = "tls"
+	ListenerWebsocket = "websocket"
+	ListenerUnix      = "unix"
+)
+
+// ListenerConfig describes one MQTT listener of the broker.
+type ListenerConfig struct {
+	Name           string   `yaml:"name"`
+	Type           string   `yaml:"type"`
+	Address        string   `yaml:"address"`
+	Path           string   `yaml:"path"`
+	AllowedOrigins []string `yaml:"allowed_origins"`
+	TLS            bool     `yaml:"tls"`
+	ProxyProtocol  bool     `yaml:"proxy_protocol"`
+	TrustedProxies []string `yaml:"trusted_proxies"`
+}
+
+// ListenerConfigs returns the listeners from the listeners file, or the ones
+// derived from the individual address settings when there is no such file.
+func (c *BrokerConfig) ListenerConfigs() []ListenerConfig {
+	if len(c.Listeners) > 0 {
+		return c.Listeners
+	}
+	return c.defaultListeners()
+}
+
+func (c *BrokerConfig) loadListeners() ([]ListenerConfig, error) {
+	listenersFile, err := os.Open(c.ListenersFilePath)
+	if err != nil {
+		slog.Info("Failed to open listeners file", "err", err)
+		return nil, err
+	}
+	defer listenersFile.Close()
+
+	listenersData, err := io.ReadAll(listenersFile)
+	if err != nil {
+		slog.Error("Failed to read listeners file", "err", err)
+		return nil, err
+	}
+
+	configs := []ListenerConfig{}
+	err = yaml.Unmarshal(listenersData, &configs)
+	if err != nil {
+		slog.Error("Failed to parse listeners", "err", err)
+		return nil, err
+	}
+
+	return configs, nil
+}
+
+func (c *BrokerConfig) defaultListeners() []ListenerConfig {
+	configs := []ListenerConfig{}
+
+	if c.TCPAddr != "" {
+		configs = append(configs, ListenerConfig{Name: ListenerTCP, Type: ListenerTCP, Address: c.TCPAddr})
+	}
+	if c.TLSEnabled() {
+		configs = append(configs, ListenerConfig{Name: ListenerTLS, Type: ListenerTLS, Address: c.TLSAddr})
+	}
+	if c.WSAddr != "" {
+		configs = append(configs, ListenerConfig{
+			Name:           ListenerWebsocket,
+			Type:           ListenerWebsocket,
+			Address:        c.WSAddr,
+			Path:           c.WSPath,
+			AllowedOrigins: c.WSAllowedOrigins,
+			TLS:            c.WSTLS,
+		})
+	}
+
+	for i := range configs {
+		configs[i].ProxyProtocol = c.ProxyProtocol
+		configs[i].TrustedProxies = c.ProxyTrustedCIDRs
+	}
+
+	return configs
+}
+
+// validateListeners checks listener names are unique and types are known.
+func validateListeners(configs []ListenerConfig, hasCertificate bool) error {
+	names := make(map[string]bool)
+
+	for _, config := range configs {
+		if config.Name == "" {
+			return fmt.Errorf("listener on %q has no name", config.Address)
+		}
+		if names[config.Name] {
+			return fmt.Errorf("duplicate listener name %q", config.Name)
+		}
+		names[config.Name] = true
+
+		if config.Address == "" {
+			return fmt.Errorf("listener %q has no address", config.Name)
+		}
+
+		if config.ProxyProtocol {
+			if config.Type != ListenerUnix && len(config.TrustedProxies) == 0 {
+				return fmt.Errorf("listener %q enables the PROXY protocol without trusted proxies", config.Name)
+			}
+			_, err := lib.ParseCIDRs(config.TrustedProxies)
+			if err != nil {
+				return fmt.Errorf("listener %q has invalid trusted proxies: %w", config.Name, err)
+			}
+		}
+
+		switch config.Type {
+		case ListenerTCP, ListenerUnix:
+		case ListenerTLS:
+			if !hasCertificate {
+				return fmt.Errorf("listener %q requires a certificate and key", config.Name)
+			}
+		case ListenerWebsocket:
+			if config.TLS && !hasCertificate {
+				return fmt.Errorf("listener %q requires a certificate and key", config.Name)
+			}
+		default:
+			return fmt.Errorf("listener %q has unknown type %q", config.Name, config.Type)
+		}
+	}
+
+	return nil
+}
+
+// newListener creates the mochi listener described by a validated config.
+func newListener(config ListenerConfig, tlsConfig *tls.Config) listeners.Listener {
+	var listener interface {
+		listeners.Listener
+		SetProxyProtocol(trusted []*net.IPNet)
+	}
+
+	switch config.Type {
+	case ListenerTLS:
+		listener = lib.NewStreamListener(config.Name, "tcp", config.Address, tlsConfig)
+	case ListenerWebsocket:
+		path := config.Path
+		if path == "" {
+			path = "/mqtt"
+		}
+		if !config.TLS {
+			tlsConfig = nil
+		}
+		listener = lib.NewWebsocketListener(config.Name, config.Address, path, config.AllowedOrigins, tlsConfig)
+	case ListenerUnix:
+		listener = lib.NewStreamListener(config.Name, "unix", config.Address, nil)
+	default:
+		listener = lib.NewStreamListener(config.Name, "tcp", config.Address, nil)
+	}
+
+	if config.ProxyProtocol {
+		trusted, _ := lib.ParseCIDRs(config.TrustedProxies)
+		listener.SetProxyProtocol(trusted)
+	}
+
+	return listener
+}
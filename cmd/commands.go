@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"mqtt2http/lib"
+	"os"
+	"runtime/debug"
+	"strings"
+)
+
+// version is set at build time with -ldflags "-X main.version=...".
+var version = "dev"
+
+func validate(args []string) error {
+	fs := flag.NewFlagSet("validate", flag.ExitOnError)
+	loadConfig := configFlags(fs)
+	fs.Parse(args)
+
+	config := loadConfig()
+	err := config.Validate()
+	if err != nil {
+		return err
+	}
+
+	fmt.Println("Configuration is valid")
+	return nil
+}
+
+func printVersion() {
+	fmt.Printf("mqtt2http %s\n", version)
+
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return
+	}
+	fmt.Printf("go: %s\n", info.GoVersion)
+	for _, setting := range info.Settings {
+		switch setting.Key {
+		case "vcs.revision", "vcs.time", "vcs.modified":
+			fmt.Printf("%s: %s\n", strings.TrimPrefix(setting.Key, "vcs."), setting.Value)
+		}
+	}
+}
+
+func routes(args []string) error {
+	if len(args) == 0 || args[0] != "test" {
+		return errors.New("usage: mqtt2http routes test [flags] <topic>...")
+	}
+
+	fs := flag.NewFlagSet("routes test", flag.ExitOnError)
+	listener := fs.String("listener", "", "only consider routes accepting this listener")
+	loadConfig := configFlags(fs)
+	fs.Parse(args[1:])
+
+	if fs.NArg() == 0 {
+		return errors.New("at least one topic is required")
+	}
+
+	config := loadConfig()
+	config.Load()
+
+	for _, topic := range fs.Args() {
+		matched := false
+		for _, route := range config.Routes {
+			if *listener != "" && !route.MatchListener(*listener) {
+				continue
+			}
+			ok, err := route.Match(topic)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "route %q has an invalid pattern: %v\n", route.Name, err)
+				continue
+			}
+			if ok {
+				matched = true
+				url := strings.Replace(route.URL, "{topic}", topic, 1)
+				if url == "" {
+					url = "(dropped)"
+				}
+				fmt.Printf("%s\t%s\t%s\n", topic, route.Name, url)
+				break
+			}
+		}
+		if !matched {
+			fmt.Printf("%s\t(no match)\n", topic)
+		}
+	}
+
+	return nil
+}
+
+// passwd adds or updates a user of the users file. The password is read
+// from the first line of the standard input.
+func passwd(args []string) error {
+	fs := flag.NewFlagSet("passwd", flag.ExitOnError)
+	file := fs.String("file", getEnv("MQTT2HTTP_USERS_FILE_PATH", ""), "users file to update, required (env MQTT2HTTP_USERS_FILE_PATH)")
+	groups := fs.String("groups", "", "comma separated groups of the user")
+	algorithm := fs.String("algorithm", lib.HashBcrypt, "password hash: bcrypt or argon2id")
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		return errors.New("usage: mqtt2http passwd [flags] <username>")
+	}
+	if *file == "" {
+		return errors.New("missing users file, set -file or MQTT2HTTP_USERS_FILE_PATH")
+	}
+
+	fmt.Fprint(os.Stderr, "Password: ")
+	scanner := bufio.NewScanner(os.Stdin)
+	if !scanner.Scan() {
+		return errors.New("no password given on standard input")
+	}
+	password := strings.TrimRight(scanner.Text(), "\r")
+	if password == "" {
+		return errors.New("empty password")
+	}
+
+	hash, err := lib.HashPassword(password, *algorithm)
+	if err != nil {
+		return err
+	}
+
+	user := lib.User{Username: fs.Arg(0), Hash: hash, Groups: splitList(*groups)}
+	err = lib.SetUser(*file, user)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(os.Stderr, "\nUpdated user %q in %s\n", user.Username, *file)
+	return nil
+}
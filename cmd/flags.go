@@ -0,0 +1,184 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log/slog"
+	"mqtt2http/broker"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// configFlags registers one flag per environment variable on fs. Flags
+// default to the value of their environment variable, so a flag given on
+// the command line always wins over the environment.
+func configFlags(fs *flag.FlagSet) func() *broker.BrokerConfig {
+	config := &broker.BrokerConfig{}
+
+	stringFlag(fs, &config.TCPAddr, "mqtt-listen-address", "MQTT2HTTP_MQTT_LISTEN_ADDRESS", ":1883", "address where the MQTT broker listens")
+	stringFlag(fs, &config.HTTPAddr, "http-listen-address", "MQTT2HTTP_HTTP_LISTEN_ADDRESS", ":8080", "address for the HTTP REST API")
+	stringFlag(fs, &config.AuthorizeURL, "authorize-url", "MQTT2HTTP_AUTHORIZE_URL", "http://127.0.0.1/authorize", "endpoint for authorizing CONNECT requests")
+	stringFlag(fs, &config.AuthorizeURLFile, "authorize-url-file", "MQTT2HTTP_AUTHORIZE_URL_FILE", "", "file holding the authorize URL")
+	stringFlag(fs, &config.AuthorizeFormat, "authorize-format", "MQTT2HTTP_AUTHORIZE_FORMAT", "basic", "how client details are sent to the authorize URL: basic, json or headers")
+	durationFlag(fs, &config.AuthCacheTTL, "auth-cache-ttl", "MQTT2HTTP_AUTH_CACHE_TTL", 0, "how long successful authorize answers are cached, 0 to disable")
+	durationFlag(fs, &config.AuthNegativeTTL, "auth-negative-ttl", "MQTT2HTTP_AUTH_NEGATIVE_TTL", 0, "how long denied authorize answers are cached, 0 to disable")
+	stringFlag(fs, &config.JWKSFile, "jwks-file", "MQTT2HTTP_JWKS_FILE", "", "JSON Web Key Set file used to verify JWT passwords")
+	stringFlag(fs, &config.JWKSURL, "jwks-url", "MQTT2HTTP_JWKS_URL", "", "JSON Web Key Set URL used to verify JWT passwords")
+	durationFlag(fs, &config.JWKSRefresh, "jwks-refresh", "MQTT2HTTP_JWKS_REFRESH", 10*time.Minute, "how often the JWKS URL is downloaded again")
+	stringFlag(fs, &config.JWTIssuer, "jwt-issuer", "MQTT2HTTP_JWT_ISSUER", "", "required iss claim of JWTs")
+	stringFlag(fs, &config.JWTAudience, "jwt-audience", "MQTT2HTTP_JWT_AUDIENCE", "", "required aud claim of JWTs")
+	stringFlag(fs, &config.JWTUsernameClaim, "jwt-username-claim", "MQTT2HTTP_JWT_USERNAME_CLAIM", "sub", "JWT claim used as username")
+	stringFlag(fs, &config.JWTPermissions, "jwt-permissions-claim", "MQTT2HTTP_JWT_PERMISSIONS_CLAIM", "mqtt", "JWT claim holding the session permissions")
+	stringFlag(fs, &config.UsersFilePath, "users-file-path", "MQTT2HTTP_USERS_FILE_PATH", "", "file of users with bcrypt or argon2id password hashes")
+	listFlag(fs, &config.Authenticators, "authenticators", "MQTT2HTTP_AUTHENTICATORS", "", "comma separated, ordered authenticators: http, file, jwt, client-cert, anonymous")
+	stringFlag(fs, &config.AuthFailurePolicy, "auth-failure-policy", "MQTT2HTTP_AUTH_FAILURE_POLICY", "closed", "what happens when an authenticator fails: closed, open or known")
+	durationFlag(fs, &config.AuthKnownTTL, "auth-known-ttl", "MQTT2HTTP_AUTH_KNOWN_TTL", 24*time.Hour, "how long clients are known after authenticating, for the known failure policy")
+	stringFlag(fs, &config.CertUsername, "cert-username", "MQTT2HTTP_CERT_USERNAME", "{cn}", "template building the username of client certificates, e.g. {cn} or {san_dns}")
+	stringFlag(fs, &config.CertRevokedFile, "cert-revoked-file", "MQTT2HTTP_CERT_REVOKED_FILE", "", "file of revoked client certificate SHA-256 fingerprints")
+	floatFlag(fs, &config.ConnectRateIP, "connect-rate-ip", "MQTT2HTTP_CONNECT_RATE_IP", 0, "connect attempts per second allowed from one IP, 0 to disable")
+	intFlag(fs, &config.ConnectBurstIP, "connect-burst-ip", "MQTT2HTTP_CONNECT_BURST_IP", 10, "connect attempts allowed at once from one IP")
+	floatFlag(fs, &config.ConnectRateUser, "connect-rate-username", "MQTT2HTTP_CONNECT_RATE_USERNAME", 0, "connect attempts per second allowed for one username, 0 to disable")
+	intFlag(fs, &config.ConnectBurstUser, "connect-burst-username", "MQTT2HTTP_CONNECT_BURST_USERNAME", 5, "connect attempts allowed at once for one username")
+	intFlag(fs, &config.AuthMaxFailures, "auth-max-failures", "MQTT2HTTP_AUTH_MAX_FAILURES", 0, "failed authentications in a row before an IP or username is locked out, 0 to disable")
+	durationFlag(fs, &config.AuthLockout, "auth-lockout", "MQTT2HTTP_AUTH_LOCKOUT", time.Minute, "duration of the first lockout, doubled for every further one")
+	durationFlag(fs, &config.AuthMaxLockout, "auth-max-lockout", "MQTT2HTTP_AUTH_MAX_LOCKOUT", time.Hour, "longest lockout")
+	intFlag(fs, &config.MaxSessions, "max-sessions-per-username", "MQTT2HTTP_MAX_SESSIONS_PER_USERNAME", 0, "concurrent sessions allowed per username, 0 for no limit")
+	stringFlag(fs, &config.SessionPolicy, "session-limit-policy", "MQTT2HTTP_SESSION_LIMIT_POLICY", "reject-new", "what happens beyond the sessions of a username: reject-new or kick-oldest")
+	stringFlag(fs, &config.ClientIDTakeover, "client-id-takeover", "MQTT2HTTP_CLIENT_ID_TAKEOVER", "allow", "who may take over the session of a connected client ID: allow, same-username or reject")
+	stringFlag(fs, &config.BansFilePath, "bans-file-path", "MQTT2HTTP_BANS_FILE_PATH", "bans.json", "file where bans are saved (kept in memory only when empty)")
+	stringFlag(fs, &config.PublishURL, "publish-url", "MQTT2HTTP_PUBLISH_URL", "http://127.0.0.1/publish/{topic}", "URL of the default route")
+	stringFlag(fs, &config.PublishURLFile, "publish-url-file", "MQTT2HTTP_PUBLISH_URL_FILE", "", "file holding the publish URL")
+	stringFlag(fs, &config.ContentType, "content-type", "MQTT2HTTP_CONTENT_TYPE", "application/octet-stream", "Content-Type header of forwarded requests")
+	stringFlag(fs, &config.TopicHeader, "topic-header", "MQTT2HTTP_TOPIC_HEADER", "X-Topic", "HTTP header that carries the MQTT topic")
+	stringFlag(fs, &config.MetricsHTTPAddr, "metrics-http-listen-address", "MQTT2HTTP_METRICS_HTTP_LISTEN_ADDRESS", ":9090", "address for the Prometheus metrics")
+	stringFlag(fs, &config.RoutesFilePath, "routes-file-path", "MQTT2HTTP_ROUTES_FILE_PATH", "routes.yaml", "path of the routes file")
+	stringFlag(fs, &config.APIPassword, "api-password", "MQTT2HTTP_API_PASSWORD", "", "password of the REST API (random when unset)")
+	stringFlag(fs, &config.APIPasswordFile, "api-password-file", "MQTT2HTTP_API_PASSWORD_FILE", "", "file holding the API password")
+	stringFlag(fs, &config.ACLURL, "acl-url", "MQTT2HTTP_ACL_URL", "", "endpoint for authorizing topic access (everything allowed when empty)")
+	stringFlag(fs, &config.ACLURLFile, "acl-url-file", "MQTT2HTTP_ACL_URL_FILE", "", "file holding the ACL URL")
+	stringFlag(fs, &config.ACLFilePath, "acl-file-path", "MQTT2HTTP_ACL_FILE_PATH", "acl.yaml", "path of the ACL rules file")
+	durationFlag(fs, &config.ACLCacheTTL, "acl-cache-ttl", "MQTT2HTTP_ACL_CACHE_TTL", time.Minute, "how long ACL answers are cached, 0 to disable")
+	stringFlag(fs, &config.TLSAddr, "mqtts-listen-address", "MQTT2HTTP_MQTTS_LISTEN_ADDRESS", ":8883", "address where the MQTT over TLS listener listens")
+	stringFlag(fs, &config.TLSCertFile, "tls-cert-file", "MQTT2HTTP_TLS_CERT_FILE", "", "PEM certificate of the TLS listener")
+	stringFlag(fs, &config.TLSKeyFile, "tls-key-file", "MQTT2HTTP_TLS_KEY_FILE", "", "PEM private key of the TLS listener")
+	stringFlag(fs, &config.TLSClientCAFile, "tls-client-ca-file", "MQTT2HTTP_TLS_CLIENT_CA_FILE", "", "PEM bundle used to verify client certificates")
+	stringFlag(fs, &config.TLSClientAuth, "tls-client-auth", "MQTT2HTTP_TLS_CLIENT_AUTH", "", "client certificate policy: none, optional or require")
+	stringFlag(fs, &config.TLSMinVersion, "tls-min-version", "MQTT2HTTP_TLS_MIN_VERSION", "1.2", "minimum TLS version")
+	stringFlag(fs, &config.TLSCipherSuites, "tls-cipher-suites", "MQTT2HTTP_TLS_CIPHER_SUITES", "", "comma separated list of allowed cipher suites")
+	stringFlag(fs, &config.WSAddr, "ws-listen-address", "MQTT2HTTP_WS_LISTEN_ADDRESS", "", "address of the MQTT over WebSocket listener (disabled when empty)")
+	stringFlag(fs, &config.WSPath, "ws-path", "MQTT2HTTP_WS_PATH", "/mqtt", "HTTP path of the WebSocket endpoint")
+	listFlag(fs, &config.WSAllowedOrigins, "ws-allowed-origins", "MQTT2HTTP_WS_ALLOWED_ORIGINS", "", "comma separated origins allowed to open WebSocket connections, * for any")
+	boolFlag(fs, &config.ProxyProtocol, "proxy-protocol", "MQTT2HTTP_PROXY_PROTOCOL", false, "read PROXY protocol headers on the default listeners")
+	listFlag(fs, &config.ProxyTrustedCIDRs, "proxy-trusted-cidrs", "MQTT2HTTP_PROXY_TRUSTED_CIDRS", "", "comma separated CIDRs allowed to send PROXY protocol headers")
+	stringFlag(fs, &config.ListenersFilePath, "listeners-file-path", "MQTT2HTTP_LISTENERS_FILE_PATH", "listeners.yaml", "path of the listeners file")
+	boolFlag(fs, &config.WSTLS, "ws-tls", "MQTT2HTTP_WS_TLS", false, "serve WebSocket over TLS with the TLS certificate")
+
+	return func() *broker.BrokerConfig {
+		if !isSet(fs, "api-password") && !isEnvSet("MQTT2HTTP_API_PASSWORD") {
+			config.APIPassword = uuid.NewString()
+		}
+		return config
+	}
+}
+
+func stringFlag(fs *flag.FlagSet, p *string, name string, key string, fallback string, usage string) {
+	fs.StringVar(p, name, getEnv(key, fallback), fmt.Sprintf("%s (env %s)", usage, key))
+}
+
+func boolFlag(fs *flag.FlagSet, p *bool, name string, key string, fallback bool, usage string) {
+	value := fallback
+	if env, ok := os.LookupEnv(key); ok {
+		parsed, err := strconv.ParseBool(env)
+		if err != nil {
+			slog.Warn("Ignoring invalid boolean", "env", key, "value", env)
+		} else {
+			value = parsed
+		}
+	}
+	fs.BoolVar(p, name, value, fmt.Sprintf("%s (env %s)", usage, key))
+}
+
+func intFlag(fs *flag.FlagSet, p *int, name string, key string, fallback int, usage string) {
+	value := fallback
+	if env, ok := os.LookupEnv(key); ok {
+		parsed, err := strconv.Atoi(env)
+		if err != nil {
+			slog.Warn("Ignoring invalid integer", "env", key, "value", env)
+		} else {
+			value = parsed
+		}
+	}
+	fs.IntVar(p, name, value, fmt.Sprintf("%s (env %s)", usage, key))
+}
+
+func floatFlag(fs *flag.FlagSet, p *float64, name string, key string, fallback float64, usage string) {
+	value := fallback
+	if env, ok := os.LookupEnv(key); ok {
+		parsed, err := strconv.ParseFloat(env, 64)
+		if err != nil {
+			slog.Warn("Ignoring invalid number", "env", key, "value", env)
+		} else {
+			value = parsed
+		}
+	}
+	fs.Float64Var(p, name, value, fmt.Sprintf("%s (env %s)", usage, key))
+}
+
+func durationFlag(fs *flag.FlagSet, p *time.Duration, name string, key string, fallback time.Duration, usage string) {
+	value := fallback
+	if env, ok := os.LookupEnv(key); ok {
+		parsed, err := time.ParseDuration(env)
+		if err != nil {
+			slog.Warn("Ignoring invalid duration", "env", key, "value", env)
+		} else {
+			value = parsed
+		}
+	}
+	fs.DurationVar(p, name, value, fmt.Sprintf("%s (env %s)", usage, key))
+}
+
+func listFlag(fs *flag.FlagSet, p *[]string, name string, key string, fallback string, usage string) {
+	*p = splitList(getEnv(key, fallback))
+	fs.Func(name, fmt.Sprintf("%s (env %s)", usage, key), func(value string) error {
+		*p = splitList(value)
+		return nil
+	})
+}
+
+// splitList splits a comma separated value, ignoring empty items.
+func splitList(value string) []string {
+	items := []string{}
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+func isSet(fs *flag.FlagSet, name string) bool {
+	set := false
+	fs.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
+}
+
+func isEnvSet(key string) bool {
+	_, ok := os.LookupEnv(key)
+	return ok
+}
+
+func getEnv(key, fallback string) string {
+	if value, ok := os.LookupEnv(key); ok {
+		return value
+	}
+	return fallback
+}
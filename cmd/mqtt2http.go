@@ -1,62 +1,110 @@
 package main
 
 import (
+	"flag"
+	"fmt"
 	"log/slog"
 	"mqtt2http/broker"
 	"os"
 	"os/signal"
 	"syscall"
 
-	"github.com/google/uuid"
 	"github.com/joho/godotenv"
 	"github.com/prometheus/client_golang/prometheus"
 )
 
+const usage = `Usage: mqtt2http [command] [flags]
+
+Commands:
+  serve         start the broker (default)
+  validate      check the configuration and exit
+  version       print build information
+  routes test   print the route matching each given topic
+  passwd        add or update a user of the users file
+
+Run "mqtt2http <command> --help" for the flags of a command.
+`
+
 func main() {
-	err := godotenv.Load()
-	if err != nil {
+	if err := godotenv.Load(); err != nil {
 		slog.Info("Did not load .env file", "err", err)
 	}
 
-	done := make(chan bool, 1)
-	sigs := make(chan os.Signal, 1)
-	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
-
-	config := &broker.BrokerConfig{
-		TCPAddr:         getEnv("MQTT2HTTP_MQTT_LISTEN_ADDRESS", ":1883"),
-		HTTPAddr:        getEnv("MQTT2HTTP_HTTP_LISTEN_ADDRESS", ":8080"),
-		AuthorizeURL:    getEnv("MQTT2HTTP_AUTHORIZE_URL", "http://127.0.0.1/authorize"),
-		PublishURL:      getEnv("MQTT2HTTP_PUBLISH_URL", "http://127.0.0.1/publish/{topic}"),
-		ContentType:     getEnv("MQTT2HTTP_CONTENT_TYPE", "application/octet-stream"),
-		TopicHeader:     getEnv("MQTT2HTTP_TOPIC_HEADER", "X-Topic"),
-		MetricsHTTPAddr: getEnv("MQTT2HTTP_METRICS_HTTP_LISTEN_ADDRESS", ":9090"),
-		RoutesFilePath:  getEnv("MQTT2HTTP_ROUTES_FILE_PATH", "routes.yaml"),
-		APIPassword:     getEnv("MQTT2HTTP_API_PASSWORD", uuid.NewString()),
+	args := os.Args[1:]
+	command := "serve"
+	if len(args) > 0 && len(args[0]) > 0 && args[0][0] != '-' {
+		command, args = args[0], args[1:]
 	}
+
+	var err error
+	switch command {
+	case "serve":
+		err = serve(args)
+	case "validate":
+		err = validate(args)
+	case "version":
+		printVersion()
+	case "routes":
+		err = routes(args)
+	case "passwd":
+		err = passwd(args)
+	case "help":
+		fmt.Print(usage)
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n%s", command, usage)
+		os.Exit(2)
+	}
+
+	if err != nil {
+		slog.Error("Command failed", "command", command, "err", err)
+		os.Exit(1)
+	}
+}
+
+func serve(args []string) error {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprint(fs.Output(), usage, "\nFlags:\n")
+		fs.PrintDefaults()
+	}
+	showVersion := fs.Bool("version", false, "print build information and exit")
+	loadConfig := configFlags(fs)
+	fs.Parse(args)
+
+	if *showVersion {
+		printVersion()
+		return nil
+	}
+
+	config := loadConfig()
 	config.Load()
 
+	done := make(chan bool, 1)
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+
+	slog.Info("Starting mqtt2http", "version", version)
 	broker := broker.NewBroker(config)
-	err = broker.Start(prometheus.DefaultRegisterer)
+	err := broker.Start(prometheus.DefaultRegisterer)
 	if err != nil {
-		slog.Error("Failed to start", "err", err)
-		panic(err)
+		return fmt.Errorf("failed to start: %w", err)
 	}
 
 	// Handle signals
 	go func() {
-		sig := <-sigs
-		slog.Info("Signal received", "signal", sig.String())
-		broker.Close()
-		done <- true
+		for sig := range sigs {
+			slog.Info("Signal received", "signal", sig.String())
+			if sig == syscall.SIGHUP {
+				broker.Reload()
+				continue
+			}
+			broker.Close()
+			done <- true
+			return
+		}
 	}()
 
 	<-done
 	slog.Info("Exiting")
-}
-
-func getEnv(key, fallback string) string {
-	if value, ok := os.LookupEnv(key); ok {
-		return value
-	}
-	return fallback
+	return nil
 }
@@ -3,6 +3,7 @@ package hooks
 import (
 	"bytes"
 	"mqtt2http/lib"
+	"sync"
 
 	mqtt "github.com/mochi-mqtt/server/v2"
 	"github.com/mochi-mqtt/server/v2/packets"
@@ -13,6 +14,8 @@ type PublishHook struct {
 	HTTPClient *lib.HTTPClient
 	Routes     []lib.Route
 	Store      *lib.ClientStore
+	Topics     *lib.TopicStats
+	mutex      sync.RWMutex
 }
 
 func (h *PublishHook) ID() string {
@@ -30,12 +33,30 @@ func (h *PublishHook) Init(config any) error {
 	return nil
 }
 
+func (h *PublishHook) SetRoutes(routes []lib.Route) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	h.Routes = routes
+}
+
 func (h *PublishHook) OnPublish(cl *mqtt.Client, pk packets.Packet) (packets.Packet, error) {
-	h.Log.Info("Received from client", "client", cl.ID, "topic", pk.TopicName, "payload", string(pk.Payload))
+	h.Log.Info("Received from client", "client", cl.ID, "listener", cl.Net.Listener, "topic", pk.TopicName, "payload", string(pk.Payload))
 	h.Store.Publish(cl.ID, pk.TopicName)
+	h.Topics.Publish(pk.TopicName)
+
+	h.mutex.RLock()
+	routes := h.Routes
+	h.mutex.RUnlock()
+
+	client, _ := h.Store.Get(cl.ID)
+	username := string(cl.Properties.Username)
 
 	matched := false
-	for _, route := range h.Routes {
+	for _, route := range routes {
+		if !route.MatchListener(cl.Net.Listener) || !route.MatchUsername(username) {
+			continue
+		}
 		ok, err := route.Match(pk.TopicName)
 		if err != nil {
 			h.Log.Error("Error while matching route pattern with topic", "err", err, "name", route.Name)
@@ -46,7 +67,7 @@ func (h *PublishHook) OnPublish(cl *mqtt.Client, pk packets.Packet) (packets.Pac
 			if route.URL == "" {
 				break
 			}
-			err := h.HTTPClient.Publish(route.URL, pk.TopicName, pk.Payload)
+			err := h.HTTPClient.Publish(route, pk.TopicName, pk.Payload, client)
 			if err != nil {
 				h.Log.Error("Failed to post on publish", "err", err, "URL", route.URL)
 			}
@@ -2,16 +2,39 @@ package hooks
 
 import (
 	"bytes"
+	"errors"
 	"mqtt2http/lib"
+	"net/http"
+	"sync"
 
 	mqtt "github.com/mochi-mqtt/server/v2"
 	"github.com/mochi-mqtt/server/v2/packets"
 )
 
+// connackCodes3 maps the reason codes refusing clients to MQTT 3 return
+// codes. Others are reported as server unavailable.
+var connackCodes3 = map[byte]byte{
+	packets.ErrClientIdentifierNotValid.Code: packets.Err3ClientIdentifierNotValid.Code,
+	packets.ErrBadUsernameOrPassword.Code:    packets.ErrMalformedUsernameOrPassword.Code,
+	packets.ErrNotAuthorized.Code:            packets.Err3NotAuthorized.Code,
+	packets.ErrBanned.Code:                   packets.Err3NotAuthorized.Code,
+}
+
 type SessionHook struct {
 	mqtt.HookBase
-	HTTPClient *lib.HTTPClient
-	Store      *lib.ClientStore
+	Server   *mqtt.Server
+	Auth     *lib.AuthChain
+	Limiter  *lib.ConnectLimiter
+	Bans     *lib.BanList
+	ACL      *lib.ACLClient
+	ACLRules *lib.ACLRules
+	Store    *lib.ClientStore
+	mutex    sync.RWMutex
+
+	// pending holds the records of the admitted clients until their session
+	// is established.
+	pending      map[*mqtt.Client]*lib.Client
+	pendingMutex sync.Mutex
 }
 
 func (h *SessionHook) ID() string {
@@ -20,9 +43,18 @@ func (h *SessionHook) ID() string {
 
 func (h *SessionHook) Provides(b byte) bool {
 	return bytes.Contains([]byte{
+		mqtt.OnConnect,
 		mqtt.OnConnectAuthenticate,
+		mqtt.OnPacketRead,
+		mqtt.OnPacketEncode,
+		mqtt.OnPacketSent,
+		mqtt.OnQosPublish,
 		mqtt.OnACLCheck,
+		mqtt.OnPublish,
 		mqtt.OnSubscribe,
+		mqtt.OnSubscribed,
+		mqtt.OnUnsubscribed,
+		mqtt.OnSessionEstablished,
 		mqtt.OnDisconnect,
 	}, []byte{b})
 }
@@ -32,42 +64,499 @@ func (h *SessionHook) Init(config any) error {
 	return nil
 }
 
-func (h *SessionHook) OnConnectAuthenticate(cl *mqtt.Client, pk packets.Packet) bool {
+func (h *SessionHook) SetACLRules(rules *lib.ACLRules) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	h.ACLRules = rules
+}
+
+// OnConnect authenticates the client, so that it can be refused with a
+// reason code telling bad credentials from an unavailable authenticator.
+// Banned clients, and clients exceeding the connect rate or locked out
+// after failed authentications, are refused before any authenticator is
+// asked.
+func (h *SessionHook) OnConnect(cl *mqtt.Client, pk packets.Packet) error {
 	username := string(cl.Properties.Username)
-	password := string(pk.Connect.Password)
 
-	h.Log.Debug("Client tries to connect", "username", username)
-	res, err := h.HTTPClient.Authorize(username, password)
+	if err := h.checkBan(cl, username); err != nil {
+		return err
+	}
+	if h.Limiter != nil {
+		err := h.Limiter.Allow(cl.Net.Remote, username)
+		if err != nil {
+			h.Log.Info("Connect refused", "err", err, "client", cl.ID, "username", username, "listener", cl.Net.Listener, "remote", cl.Net.Remote)
+			return h.refuse(cl, packets.ErrConnectionRateExceeded, "")
+		}
+	}
+
+	h.Log.Debug("Client tries to connect", "username", username, "listener", cl.Net.Listener, "remote", cl.Net.Remote)
+	request := newAuthRequest(cl, pk)
+	identity, err := h.Auth.Authenticate(request)
 	if err != nil {
-		h.Log.Error("Auth request failed", "err", err)
-		return false
+		h.Log.Info("Auth denied", "err", err, "client", cl.ID, "username", username, "listener", cl.Net.Listener, "remote", cl.Net.Remote)
+		var failed *lib.AuthFailedError
+		if errors.As(err, &failed) {
+			return h.refuse(cl, packets.ErrServerUnavailable, "")
+		}
+
+		if h.Limiter != nil {
+			h.Limiter.Failure(cl.Net.Remote, username)
+		}
+		code := packets.ErrBadUsernameOrPassword
+		reason := ""
+		var authErr *lib.AuthError
+		if errors.As(err, &authErr) {
+			if authErr.StatusCode == http.StatusForbidden {
+				code = packets.ErrNotAuthorized
+			}
+			reason = authErr.Reason
+		}
+		return h.refuse(cl, code, reason)
 	}
-	if !res {
-		h.Log.Info("Auth denied", "client", cl.ID, "username", username)
-		return false
+	if h.Limiter != nil {
+		h.Limiter.Success(cl.Net.Remote, username)
 	}
 
-	h.Store.Enter(cl.ID, username)
+	// JWTs and client certificates carry their own username.
+	if identity.Username != username {
+		cl.Properties.Username = []byte(identity.Username)
+	}
+	if identity.Session != nil {
+		applySession(cl, identity.Session)
+	}
+	if err := h.checkBan(cl, identity.Username); err != nil {
+		return err
+	}
+
+	client := lib.NewClient(cl.ID, identity.Username, cl.Net.Listener, cl.Net.Remote)
+	client.Groups = identity.Groups
+	client.Permissions = identity.Permissions
+	client.MaxSessions = identity.MaxSessions
+	client.Session = identity.Session
+	client.Conn = cl.Net.Conn
+	if request.Certificate != nil {
+		client.Certificate = lib.NewCertificateIdentity(request.Certificate)
+	}
+	evicted, err := h.Store.Admit(client)
+	if err != nil {
+		h.Log.Info("Session refused", "err", err, "client", cl.ID, "username", identity.Username, "listener", cl.Net.Listener, "remote", cl.Net.Remote)
+		return h.refuse(cl, sessionRefusedCode(err), "")
+	}
+	h.evict(evicted)
+	h.setPending(cl, client)
+
+	return nil
+}
+
+// sessionRefusedCode returns the reason code refusing a session the store
+// did not admit.
+func sessionRefusedCode(err error) packets.Code {
+	if errors.Is(err, lib.ErrClientIDInUse) {
+		return packets.ErrClientIdentifierNotValid
+	}
+	return packets.ErrQuotaExceeded
+}
+
+func (h *SessionHook) evict(evicted []*lib.Client) {
+	for _, old := range evicted {
+		h.Log.Info("Disconnecting oldest session of the username", "client", old.ID, "username", old.Username)
+		h.disconnect(old.ID, packets.ErrSessionTakenOver)
+	}
+}
+
+// setPending keeps the record of an admitted client until its session is
+// established. mochi does not call OnDisconnect when the connect fails
+// after OnConnect, so the records of closed clients are dropped here.
+func (h *SessionHook) setPending(cl *mqtt.Client, client *lib.Client) {
+	h.pendingMutex.Lock()
+	defer h.pendingMutex.Unlock()
+
+	if h.pending == nil {
+		h.pending = make(map[*mqtt.Client]*lib.Client)
+	}
+	for other := range h.pending {
+		if other.Closed() {
+			delete(h.pending, other)
+		}
+	}
+	h.pending[cl] = client
+}
+
+func (h *SessionHook) takePending(cl *mqtt.Client) (*lib.Client, bool) {
+	h.pendingMutex.Lock()
+	defer h.pendingMutex.Unlock()
 
+	client, ok := h.pending[cl]
+	delete(h.pending, cl)
+	return client, ok
+}
+
+// checkBan refuses the client when a ban applies to it.
+func (h *SessionHook) checkBan(cl *mqtt.Client, username string) error {
+	if h.Bans == nil {
+		return nil
+	}
+	ban, ok := h.Bans.Match(cl.ID, username, cl.Net.Remote)
+	if !ok {
+		return nil
+	}
+	h.Log.Info("Banned client refused", "kind", ban.Kind, "value", ban.Value, "client", cl.ID, "username", username, "listener", cl.Net.Listener, "remote", cl.Net.Remote)
+	return h.refuse(cl, packets.ErrBanned, ban.Reason)
+}
+
+// OnConnectAuthenticate allows the clients that OnConnect let through.
+func (h *SessionHook) OnConnectAuthenticate(cl *mqtt.Client, pk packets.Packet) bool {
 	return true
 }
 
+// OnPacketRead counts the bytes received from the client, enforces the
+// maximum packet size of the session and adds its topic prefix to the
+// topics sent by the client.
+func (h *SessionHook) OnPacketRead(cl *mqtt.Client, pk packets.Packet) (packets.Packet, error) {
+	client, ok := h.connected(cl)
+	if !ok {
+		return pk, nil
+	}
+	client.Traffic.Received.Add(packetSize(pk.FixedHeader.Remaining))
+	if client.Session == nil {
+		return pk, nil
+	}
+	settings := client.Session
+
+	// Only a rejection stops mochi from processing the packet, other errors
+	// of the hook are ignored.
+	if size := packetSize(pk.FixedHeader.Remaining); settings.MaxPacketSize > 0 && size > int64(settings.MaxPacketSize) {
+		h.Log.Info("Packet too large", "client", cl.ID, "size", size, "max", settings.MaxPacketSize)
+		lib.Disconnect(h.Server, cl, packets.ErrPacketTooLarge)
+		return pk, packets.ErrRejectPacket
+	}
+
+	switch pk.FixedHeader.Type {
+	case packets.Publish:
+		// An empty topic refers to a topic alias, already prefixed.
+		if settings.TopicPrefix != "" && pk.TopicName != "" {
+			pk.TopicName = settings.PrefixTopic(pk.TopicName)
+		}
+	case packets.Subscribe, packets.Unsubscribe:
+		if settings.TopicPrefix != "" {
+			for i, sub := range pk.Filters {
+				pk.Filters[i].Filter = settings.PrefixFilter(sub.Filter)
+			}
+		}
+	case packets.Disconnect:
+		if settings.SessionExpiry != nil && pk.Properties.SessionExpiryInterval > *settings.SessionExpiry {
+			pk.Properties.SessionExpiryInterval = *settings.SessionExpiry
+		}
+	}
+	return pk, nil
+}
+
+// OnPacketEncode announces the session settings and permissions in the
+// CONNACK, and strips the topic prefix from the publications sent to the
+// client.
+func (h *SessionHook) OnPacketEncode(cl *mqtt.Client, pk packets.Packet) packets.Packet {
+	client, ok := h.connected(cl)
+	if !ok {
+		return pk
+	}
+	settings := client.Session
+
+	switch pk.FixedHeader.Type {
+	case packets.Connack:
+		if pk.ReasonCode != packets.CodeSuccess.Code {
+			return pk
+		}
+		if permissions := client.Permissions; permissions != nil {
+			if permissions.MaxQoS != nil {
+				pk.Properties.MaximumQos = *permissions.MaxQoS
+				pk.Properties.MaximumQosFlag = true
+			}
+			if !permissions.AllowsRetain() {
+				pk.Properties.RetainAvailable = 0
+				pk.Properties.RetainAvailableFlag = true
+			}
+		}
+		if settings == nil {
+			return pk
+		}
+		if settings.SessionExpiry != nil {
+			pk.Properties.SessionExpiryInterval = cl.Properties.Props.SessionExpiryInterval
+			pk.Properties.SessionExpiryIntervalFlag = true
+		}
+		if settings.ReceiveMaximum > 0 {
+			pk.Properties.ReceiveMaximum = settings.ReceiveMaximum
+		}
+		if settings.MaxPacketSize > 0 {
+			pk.Properties.MaximumPacketSize = settings.MaxPacketSize
+		}
+	case packets.Publish:
+		if settings != nil && settings.TopicPrefix != "" {
+			pk.TopicName = settings.StripTopic(pk.TopicName)
+		}
+	}
+	return pk
+}
+
+// OnQosPublish counts the QoS 1 and 2 messages queued for the client as
+// pending until they are written.
+func (h *SessionHook) OnQosPublish(cl *mqtt.Client, pk packets.Packet, sent int64, resends int) {
+	client, ok := h.connected(cl)
+	if ok && pk.FixedHeader.Type == packets.Publish {
+		client.Pending.Queued(pk.PacketID)
+	}
+}
+
+// OnPacketSent counts the bytes sent to the client. They are computed from
+// the packet, since mochi may have drained b while writing it.
+func (h *SessionHook) OnPacketSent(cl *mqtt.Client, pk packets.Packet, b []byte) {
+	client, ok := h.connected(cl)
+	if !ok {
+		return
+	}
+	client.Traffic.Sent.Add(packetSize(pk.FixedHeader.Remaining))
+	if pk.FixedHeader.Type == packets.Publish && pk.FixedHeader.Qos > 0 {
+		client.Pending.Written(pk.PacketID)
+	}
+}
+
+// packetSize returns the size of a packet on the wire: the fixed header
+// byte, the remaining length and the remaining bytes.
+func packetSize(remaining int) int64 {
+	size := 2
+	for n := remaining; n > 127; n >>= 7 {
+		size++
+	}
+	return int64(size + remaining)
+}
+
+// connected returns the record of the client, or its pending record while
+// it connects, unless it belongs to another connection with the same client
+// ID.
+func (h *SessionHook) connected(cl *mqtt.Client) (*lib.Client, bool) {
+	client, ok := h.Store.Get(cl.ID)
+	if ok && client.Conn == cl.Net.Conn {
+		return client, true
+	}
+
+	// The CONNACK is sent before the session is established.
+	h.pendingMutex.Lock()
+	defer h.pendingMutex.Unlock()
+
+	client, ok = h.pending[cl]
+	return client, ok
+}
+
+// disconnect closes the session of a connected client.
+func (h *SessionHook) disconnect(id string, code packets.Code) {
+	cl, ok := h.Server.Clients.Get(id)
+	if ok {
+		lib.Disconnect(h.Server, cl, code)
+	}
+}
+
+// refuse sends a CONNACK with the reason code, and the reason string for
+// MQTT 5 clients. MQTT 3 clients get the closest MQTT 3 return code.
+func (h *SessionHook) refuse(cl *mqtt.Client, code packets.Code, reason string) error {
+	if cl.Properties.ProtocolVersion < 5 {
+		v3code, ok := connackCodes3[code.Code]
+		if !ok {
+			v3code = packets.Err3ServerUnavailable.Code
+		}
+		ack := packets.Packet{FixedHeader: packets.FixedHeader{Type: packets.Connack}, ReasonCode: v3code}
+		err := cl.WritePacket(ack)
+		if err != nil {
+			return err
+		}
+		return code
+	}
+
+	ack := code
+	if reason != "" {
+		ack = packets.Code{Code: code.Code, Reason: reason}
+	}
+	err := h.Server.SendConnack(cl, ack, false, nil)
+	if err != nil {
+		return err
+	}
+	return code
+}
+
 func (h *SessionHook) OnACLCheck(cl *mqtt.Client, topic string, write bool) bool {
 	h.Log.Debug("ACLCheck", "client", cl.ID, "topic", topic, "write", write)
-	return true
+	username := string(cl.Properties.Username)
+
+	client, ok := h.Store.Get(cl.ID)
+	if !ok {
+		client = lib.NewClient(cl.ID, username, cl.Net.Listener, cl.Net.Remote)
+	}
+
+	if permissions := client.Permissions; permissions != nil {
+		allowed := write && permissions.CanPublish(client, topic) || !write && permissions.CanSubscribe(client, topic)
+		if !allowed {
+			h.Log.Info("Session permissions denied", "client", cl.ID, "username", username, "topic", topic, "write", write)
+			return false
+		}
+	}
+
+	h.mutex.RLock()
+	rules := h.ACLRules
+	h.mutex.RUnlock()
+
+	if rules != nil {
+		if !rules.Check(client, topic, write) {
+			h.Log.Info("ACL rules denied", "client", cl.ID, "username", username, "topic", topic, "write", write)
+			return false
+		}
+	}
+
+	if h.ACL == nil {
+		return true
+	}
+
+	allowed, err := h.ACL.Check(cl.ID, username, topic, write)
+	if err != nil {
+		h.Log.Error("ACL request failed", "err", err, "client", cl.ID, "topic", topic)
+		return false
+	}
+	if !allowed {
+		h.Log.Info("ACL denied", "client", cl.ID, "username", username, "topic", topic, "write", write)
+	}
+
+	return allowed
+}
+
+// OnPublish enforces the QoS and retain restrictions of the session.
+func (h *SessionHook) OnPublish(cl *mqtt.Client, pk packets.Packet) (packets.Packet, error) {
+	client, ok := h.Store.Get(cl.ID)
+	if !ok || client.Permissions == nil {
+		return pk, nil
+	}
+
+	code := packets.CodeSuccess
+	if !client.Permissions.AllowsQoS(pk.FixedHeader.Qos) {
+		code = packets.ErrQosNotSupported
+	} else if pk.FixedHeader.Retain && !client.Permissions.AllowsRetain() {
+		code = packets.ErrRetainNotSupported
+	}
+	if code == packets.CodeSuccess {
+		return pk, nil
+	}
+
+	h.Log.Info("Publish rejected by session permissions", "client", cl.ID, "topic", pk.TopicName, "reason", code.Reason)
+	// MQTT 5 clients receive the reason in the acknowledgement, others
+	// have the message dropped.
+	if cl.Properties.ProtocolVersion == 5 && pk.FixedHeader.Qos > 0 {
+		return pk, code
+	}
+	return pk, packets.ErrRejectPacket
 }
 
 func (h *SessionHook) OnSubscribe(cl *mqtt.Client, pk packets.Packet) packets.Packet {
 	h.Log.Debug("Subscribe", "client", cl.ID, "topic", pk.TopicName)
-	topics := []string{}
-	for _, sub := range pk.Filters {
-		topics = append(topics, sub.Filter)
+
+	client, ok := h.Store.Get(cl.ID)
+	if ok && client.Permissions != nil {
+		for i, sub := range pk.Filters {
+			pk.Filters[i].Qos = client.Permissions.LimitQoS(sub.Qos)
+		}
 	}
-	h.Store.Subscribe(cl.ID, topics)
 	return pk
 }
 
+// OnSubscribed records the subscriptions granted to the client, leaving out
+// those refused by the ACL or invalid.
+func (h *SessionHook) OnSubscribed(cl *mqtt.Client, pk packets.Packet, reasonCodes []byte) {
+	subs := []lib.Subscription{}
+	for i, sub := range pk.Filters {
+		if i < len(reasonCodes) && reasonCodes[i] < packets.ErrUnspecifiedError.Code {
+			subs = append(subs, lib.NewSubscription(sub, reasonCodes[i]))
+		}
+	}
+	h.Store.Subscribe(cl.ID, subs)
+}
+
+func (h *SessionHook) OnUnsubscribed(cl *mqtt.Client, pk packets.Packet) {
+	h.Log.Debug("Unsubscribed", "client", cl.ID)
+
+	filters := []string{}
+	for _, sub := range pk.Filters {
+		filters = append(filters, sub.Filter)
+	}
+	h.Store.Unsubscribe(cl.ID, filters)
+}
+
+// OnSessionEstablished records the subscriptions of a resumed session.
+func (h *SessionHook) OnSessionEstablished(cl *mqtt.Client, pk packets.Packet) {
+	client, ok := h.takePending(cl)
+	if !ok {
+		return
+	}
+	evicted, err := h.Store.Enter(client)
+	if err != nil {
+		h.Log.Info("Session refused", "err", err, "client", cl.ID, "username", client.Username, "listener", cl.Net.Listener, "remote", cl.Net.Remote)
+		lib.Disconnect(h.Server, cl, sessionRefusedCode(err))
+		return
+	}
+	h.evict(evicted)
+
+	subs := []lib.Subscription{}
+	for _, sub := range cl.State.Subscriptions.GetAll() {
+		subs = append(subs, lib.NewSubscription(sub, sub.Qos))
+	}
+	if len(subs) > 0 {
+		h.Store.RestoreSubscriptions(cl.ID, subs)
+	}
+}
+
 func (h *SessionHook) OnDisconnect(cl *mqtt.Client, err error, expire bool) {
-	h.Log.Debug("Disconnect", "client", cl.ID, "expire", expire)
-	h.Store.Leave(cl.ID)
+	h.Log.Debug("Disconnect", "client", cl.ID, "listener", cl.Net.Listener, "expire", expire)
+	h.Store.Leave(cl.ID, cl.Net.Conn)
+}
+
+// applySession applies the session settings of the authorize response
+// before the CONNACK is sent. The keepalive, session expiry and receive
+// maximum only exist for MQTT 5 clients.
+func applySession(cl *mqtt.Client, settings *lib.SessionSettings) {
+	if settings.ClientID != "" && settings.ClientID != cl.ID {
+		cl.ID = settings.ClientID
+		cl.Properties.Props.AssignedClientID = settings.ClientID
+	}
+	if settings.TopicPrefix != "" && cl.Properties.Will.TopicName != "" {
+		cl.Properties.Will.TopicName = settings.PrefixTopic(cl.Properties.Will.TopicName)
+	}
+
+	if cl.Properties.ProtocolVersion < 5 {
+		return
+	}
+	if settings.MaxKeepalive > 0 && (cl.State.Keepalive == 0 || cl.State.Keepalive > settings.MaxKeepalive) {
+		cl.State.Keepalive = settings.MaxKeepalive
+		cl.State.ServerKeepalive = true
+	}
+	if settings.SessionExpiry != nil && cl.Properties.Props.SessionExpiryInterval > *settings.SessionExpiry {
+		cl.Properties.Props.SessionExpiryInterval = *settings.SessionExpiry
+	}
+	if settings.ReceiveMaximum > 0 {
+		cl.State.Inflight.ResetReceiveQuota(int32(settings.ReceiveMaximum))
+	}
+}
+
+func newAuthRequest(cl *mqtt.Client, pk packets.Packet) lib.AuthRequest {
+	request := lib.AuthRequest{
+		ClientID:        cl.ID,
+		Username:        string(cl.Properties.Username),
+		Password:        string(pk.Connect.Password),
+		RemoteAddr:      cl.Net.Remote,
+		Listener:        cl.Net.Listener,
+		ProtocolVersion: cl.Properties.ProtocolVersion,
+		CleanStart:      pk.Connect.Clean,
+	}
+
+	if cert := lib.PeerCertificate(cl.Net.Conn); cert != nil {
+		request.Certificate = cert
+		request.CertSubject = cert.Subject.String()
+		request.CertFingerprint = lib.Fingerprint(cert)
+	}
+
+	return request
 }
@@ -0,0 +1,146 @@
+package lib
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// aclCacheMaxEntries triggers a sweep of expired entries when reached.
+const aclCacheMaxEntries = 10000
+
+type ACLRequest struct {
+	ClientID string `json:"client_id"`
+	Username string `json:"username"`
+	Topic    string `json:"topic"`
+	Action   string `json:"action"`
+}
+
+type aclCacheEntry struct {
+	allowed   bool
+	expiresAt time.Time
+}
+
+// ACLClient asks an HTTP endpoint whether a client may read or write a
+// topic, and caches the answers for TTL.
+type ACLClient struct {
+	URL     string
+	TTL     time.Duration
+	Metrics *Metrics
+	cache   map[ACLRequest]aclCacheEntry
+	mutex   sync.RWMutex
+}
+
+func NewACLClient(url string, ttl time.Duration, metrics *Metrics) *ACLClient {
+	return &ACLClient{
+		URL:     url,
+		TTL:     ttl,
+		Metrics: metrics,
+		cache:   make(map[ACLRequest]aclCacheEntry),
+	}
+}
+
+// SetURL changes the endpoint and forgets the cached answers.
+func (c *ACLClient) SetURL(url string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.URL = url
+	c.cache = make(map[ACLRequest]aclCacheEntry)
+}
+
+// Check returns whether the access is allowed. A 2xx answer allows it, a
+// 401 or 403 denies it, anything else is an error.
+func (c *ACLClient) Check(clientID string, username string, topic string, write bool) (bool, error) {
+	request := ACLRequest{ClientID: clientID, Username: username, Topic: topic, Action: "read"}
+	if write {
+		request.Action = "write"
+	}
+
+	c.mutex.RLock()
+	url := c.URL
+	entry, ok := c.cache[request]
+	c.mutex.RUnlock()
+
+	if ok && time.Now().Before(entry.expiresAt) {
+		c.count(entry.allowed, nil, true)
+		return entry.allowed, nil
+	}
+
+	allowed, err := c.post(url, request)
+	c.count(allowed, err, false)
+	if err != nil {
+		return false, err
+	}
+
+	if c.TTL > 0 {
+		c.store(request, allowed)
+	}
+
+	return allowed, nil
+}
+
+func (c *ACLClient) post(url string, request ACLRequest) (bool, error) {
+	body, err := json.Marshal(request)
+	if err != nil {
+		return false, err
+	}
+
+	client := &http.Client{Timeout: clientTimeout}
+
+	req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer res.Body.Close()
+
+	switch {
+	case res.StatusCode >= 200 && res.StatusCode <= 299:
+		return true, nil
+	case res.StatusCode == http.StatusUnauthorized || res.StatusCode == http.StatusForbidden:
+		return false, nil
+	}
+	return false, fmt.Errorf("acl post failed with status code %d", res.StatusCode)
+}
+
+func (c *ACLClient) store(request ACLRequest, allowed bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	now := time.Now()
+	if len(c.cache) >= aclCacheMaxEntries {
+		for key, entry := range c.cache {
+			if now.After(entry.expiresAt) {
+				delete(c.cache, key)
+			}
+		}
+	}
+	c.cache[request] = aclCacheEntry{allowed: allowed, expiresAt: now.Add(c.TTL)}
+}
+
+func (c *ACLClient) count(allowed bool, err error, cached bool) {
+	result := "deny"
+	if err != nil {
+		result = "error"
+	} else if allowed {
+		result = "allow"
+	}
+
+	labels := prometheus.Labels{
+		"result": result,
+		"cached": strconv.FormatBool(cached),
+	}
+	c.Metrics.aclCounter.With(labels).Inc()
+}
@@ -0,0 +1,164 @@
+package lib
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+const (
+	ACLAllow = "allow"
+	ACLDeny  = "deny"
+)
+
+// ACLRule grants or denies access to topic filters for the clients whose
+// username, group and client ID all match. Empty criteria match everyone.
+type ACLRule struct {
+	Permission string   `yaml:"permission"`
+	Username   string   `yaml:"username"`
+	Group      string   `yaml:"group"`
+	ClientID   string   `yaml:"client_id"`
+	Action     string   `yaml:"action"`
+	Topics     []string `yaml:"topics"`
+
+	username *regexp.Regexp
+	clientID *regexp.Regexp
+}
+
+// ACLRules is an ordered list of rules where the first matching rule wins.
+type ACLRules struct {
+	Default string              `yaml:"default"`
+	Groups  map[string][]string `yaml:"groups"`
+	Rules   []ACLRule           `yaml:"rules"`
+}
+
+// Compile validates the rules and prepares their patterns. It must be
+// called before Check.
+func (a *ACLRules) Compile() error {
+	if a.Default == "" {
+		a.Default = ACLDeny
+	}
+	if a.Default != ACLAllow && a.Default != ACLDeny {
+		return fmt.Errorf("invalid default policy %q", a.Default)
+	}
+
+	for i := range a.Rules {
+		rule := &a.Rules[i]
+		if rule.Permission != ACLAllow && rule.Permission != ACLDeny {
+			return fmt.Errorf("rule %d: invalid permission %q", i+1, rule.Permission)
+		}
+		switch rule.Action {
+		case "", "read", "write", "readwrite":
+		default:
+			return fmt.Errorf("rule %d: invalid action %q", i+1, rule.Action)
+		}
+
+		var err error
+		rule.username, err = compileAnchored(rule.Username)
+		if err != nil {
+			return fmt.Errorf("rule %d: invalid username pattern: %w", i+1, err)
+		}
+		rule.clientID, err = compileAnchored(rule.ClientID)
+		if err != nil {
+			return fmt.Errorf("rule %d: invalid client_id pattern: %w", i+1, err)
+		}
+	}
+
+	return nil
+}
+
+// Check returns whether the client may write to the topic, or subscribe to
+// the topic filter when write is false. A subscription is allowed by a rule
+// covering its filter, but denied by a rule matching any topic it receives.
+func (a *ACLRules) Check(client *Client, topic string, write bool) bool {
+	groups := a.groupsOf(client)
+	if !write {
+		topic = sharedFilterTopics(topic)
+	}
+
+	for _, rule := range a.Rules {
+		if !rule.matchesClient(client, groups) || !rule.matchesAction(write) {
+			continue
+		}
+		for _, filter := range rule.Topics {
+			filter, ok := ExpandPlaceholders(filter, client)
+			if !ok {
+				continue
+			}
+			switch {
+			case write && MatchTopic(filter, topic),
+				!write && rule.Permission == ACLAllow && CoversFilter(filter, topic),
+				!write && rule.Permission == ACLDeny && OverlapsFilter(filter, topic):
+				return rule.Permission == ACLAllow
+			}
+		}
+	}
+
+	return a.Default == ACLAllow
+}
+
+// groupsOf returns the groups of the client from the users file and from
+// the groups section of the ACL file.
+func (a *ACLRules) groupsOf(client *Client) []string {
+	groups := slices.Clone(client.Groups)
+	for group, members := range a.Groups {
+		if slices.Contains(members, client.Username) {
+			groups = append(groups, group)
+		}
+	}
+	return groups
+}
+
+func (r *ACLRule) matchesClient(client *Client, groups []string) bool {
+	if r.username != nil && !r.username.MatchString(client.Username) {
+		return false
+	}
+	if r.clientID != nil && !r.clientID.MatchString(client.ID) {
+		return false
+	}
+	if r.Group != "" && !slices.Contains(groups, r.Group) {
+		return false
+	}
+	return true
+}
+
+func (r *ACLRule) matchesAction(write bool) bool {
+	switch r.Action {
+	case "read":
+		return !write
+	case "write":
+		return write
+	}
+	return true
+}
+
+// ExpandPlaceholders replaces %u with the username, %c with the client ID
+// and %C with the certificate common name of the client in an ACL topic
+// filter. It fails when a substituted value is empty or contains characters
+// that would widen the filter.
+func ExpandPlaceholders(filter string, client *Client) (string, bool) {
+	commonName := ""
+	if client.Certificate != nil {
+		commonName = client.Certificate.CommonName
+	}
+
+	replacements := []string{}
+	for placeholder, value := range map[string]string{"%u": client.Username, "%c": client.ID, "%C": commonName} {
+		if !strings.Contains(filter, placeholder) {
+			continue
+		}
+		if value == "" || strings.ContainsAny(value, "+#/") {
+			return "", false
+		}
+		replacements = append(replacements, placeholder, value)
+	}
+	return strings.NewReplacer(replacements...).Replace(filter), true
+}
+
+func compileAnchored(pattern string) (*regexp.Regexp, error) {
+	if pattern == "" {
+		return nil, nil
+	}
+	return regexp.Compile("^(?:" + pattern + ")$")
+}
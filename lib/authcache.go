@@ -0,0 +1,219 @@
+package lib
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// authCacheMaxEntries bounds the cached answers. Expired entries are swept
+// when it is reached, then the entry expiring first is evicted.
+const authCacheMaxEntries = 10000
+
+// AuthError is returned by Authorize when the authorize endpoint answers
+// with an unsuccessful status code, with the reason of its JSON body.
+type AuthError struct {
+	StatusCode int
+	Reason     string
+}
+
+func (e *AuthError) Error() string {
+	return "auth post failed with status code " + strconv.Itoa(e.StatusCode)
+}
+
+// Denied reports whether the endpoint refused the credentials, as opposed
+// to failing to answer.
+func (e *AuthError) Denied() bool {
+	return e.StatusCode == http.StatusUnauthorized || e.StatusCode == http.StatusForbidden
+}
+
+type authCacheEntry struct {
+	response  *AuthResponse
+	err       error
+	expiresAt time.Time
+}
+
+// AuthCache remembers authorize answers so reconnecting clients do not hit
+// the authorize endpoint every time. Successful answers are kept for TTL,
+// denials for NegativeTTL. Entries are keyed on an HMAC of the request
+// with a random salt, so credentials are never kept in memory in clear.
+type AuthCache struct {
+	TTL         time.Duration
+	NegativeTTL time.Duration
+	Metrics     *Metrics
+	salt        []byte
+	entries     map[string]authCacheEntry
+	mutex       sync.RWMutex
+}
+
+// hashFields returns the hex encoded HMAC of the fields with the salt.
+func hashFields(salt []byte, fields ...string) string {
+	mac := hmac.New(sha256.New, salt)
+	for _, field := range fields {
+		mac.Write([]byte(field))
+		mac.Write([]byte{0})
+	}
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// newSalt returns random bytes to salt hashes of credentials.
+func newSalt() ([]byte, error) {
+	salt := make([]byte, 32)
+	_, err := rand.Read(salt)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate salt: %w", err)
+	}
+	return salt, nil
+}
+
+func NewAuthCache(ttl time.Duration, negativeTTL time.Duration, metrics *Metrics) (*AuthCache, error) {
+	salt, err := newSalt()
+	if err != nil {
+		return nil, err
+	}
+	return &AuthCache{
+		TTL:         ttl,
+		NegativeTTL: negativeTTL,
+		Metrics:     metrics,
+		salt:        salt,
+		entries:     make(map[string]authCacheEntry),
+	}, nil
+}
+
+// Key returns the cache key of the request. The port of the remote address
+// is left out since it changes on every connection.
+func (c *AuthCache) Key(request AuthRequest) string {
+	host, _, err := net.SplitHostPort(request.RemoteAddr)
+	if err != nil {
+		host = request.RemoteAddr
+	}
+
+	return hashFields(c.salt,
+		request.ClientID,
+		request.Username,
+		request.Password,
+		host,
+		request.Listener,
+		strconv.Itoa(int(request.ProtocolVersion)),
+		strconv.FormatBool(request.CleanStart),
+		request.CertFingerprint,
+	)
+}
+
+// Get returns the cached answer for the key, if any.
+func (c *AuthCache) Get(key string) (*AuthResponse, error, bool) {
+	c.mutex.RLock()
+	entry, ok := c.entries[key]
+	c.mutex.RUnlock()
+
+	if ok && time.Now().Before(entry.expiresAt) {
+		c.count("hit")
+		return entry.response, entry.err, true
+	}
+	c.count("miss")
+	return nil, nil, false
+}
+
+// Store caches an answer of the authorize endpoint. Only successes and
+// denials are cached, other errors are retried on the next connect. A
+// Cache-Control header of the answer overrides the configured TTL, but
+// denials are never kept longer than NegativeTTL.
+func (c *AuthCache) Store(key string, response *AuthResponse, err error, cacheControl string) {
+	ttl := c.TTL
+	if err != nil {
+		var authErr *AuthError
+		if !errors.As(err, &authErr) || !authErr.Denied() {
+			return
+		}
+		ttl = c.NegativeTTL
+	}
+
+	if maxAge, noStore, ok := parseCacheControl(cacheControl); ok {
+		if noStore {
+			return
+		}
+		if err == nil || maxAge < ttl {
+			ttl = maxAge
+		}
+	}
+	if ttl <= 0 {
+		return
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	now := time.Now()
+	if _, ok := c.entries[key]; !ok && len(c.entries) >= authCacheMaxEntries {
+		c.evict(now)
+	}
+	c.entries[key] = authCacheEntry{response: response, err: err, expiresAt: now.Add(ttl)}
+}
+
+// evict removes the expired entries, or the entry expiring first when none
+// has expired.
+func (c *AuthCache) evict(now time.Time) {
+	first := ""
+	for key, entry := range c.entries {
+		if now.After(entry.expiresAt) {
+			delete(c.entries, key)
+			continue
+		}
+		if first == "" || entry.expiresAt.Before(c.entries[first].expiresAt) {
+			first = key
+		}
+	}
+	if len(c.entries) >= authCacheMaxEntries {
+		delete(c.entries, first)
+	}
+}
+
+// Flush forgets all cached answers and returns how many there were.
+func (c *AuthCache) Flush() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	count := len(c.entries)
+	c.entries = make(map[string]authCacheEntry)
+	return count
+}
+
+func (c *AuthCache) count(result string) {
+	labels := prometheus.Labels{
+		"result": result,
+	}
+	c.Metrics.authCacheCounter.With(labels).Inc()
+}
+
+// parseCacheControl reads the max-age, no-store and no-cache directives.
+// It returns false when the header sets none of them.
+func parseCacheControl(header string) (time.Duration, bool, bool) {
+	var maxAge time.Duration
+	found := false
+	for _, directive := range strings.Split(header, ",") {
+		name, value, _ := strings.Cut(strings.TrimSpace(directive), "=")
+		switch strings.ToLower(name) {
+		case "no-store", "no-cache":
+			return 0, true, true
+		case "max-age":
+			seconds, err := strconv.Atoi(strings.Trim(value, `"`))
+			if err != nil {
+				continue
+			}
+			maxAge = time.Duration(seconds) * time.Second
+			found = true
+		}
+	}
+	return maxAge, false, found
+}
@@ -0,0 +1,271 @@
+package lib
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+type AuthResult int
+
+const (
+	// AuthAbstain leaves the decision to the next authenticator.
+	AuthAbstain AuthResult = iota
+	AuthAllow
+	AuthDeny
+)
+
+const (
+	AuthenticatorHTTP       = "http"
+	AuthenticatorFile       = "file"
+	AuthenticatorJWT        = "jwt"
+	AuthenticatorClientCert = "client-cert"
+	AuthenticatorAnonymous  = "anonymous"
+)
+
+// Policies applied when an authenticator fails to answer.
+const (
+	AuthFailClosed = "closed"
+	AuthFailOpen   = "open"
+	AuthFailKnown  = "known"
+)
+
+// knownClientsMaxEntries triggers a sweep of expired known clients when
+// reached.
+const knownClientsMaxEntries = 10000
+
+// AuthFailedError is returned when an authenticator could not answer and the
+// policy did not let the client in.
+type AuthFailedError struct {
+	Authenticator string
+	Err           error
+}
+
+func (e *AuthFailedError) Error() string {
+	return e.Authenticator + " authenticator failed: " + e.Err.Error()
+}
+
+func (e *AuthFailedError) Unwrap() error {
+	return e.Err
+}
+
+// AuthDeniedError is returned when an authenticator denied the client, or
+// when all of them abstained and Authenticator is empty. Err explains why
+// when the authenticator said so, e.g. an *AuthError.
+type AuthDeniedError struct {
+	Authenticator string
+	Err           error
+}
+
+func (e *AuthDeniedError) Error() string {
+	message := "no authenticator accepted the client"
+	if e.Authenticator != "" {
+		message = "denied by " + e.Authenticator + " authenticator"
+	}
+	if e.Err != nil {
+		message += ": " + e.Err.Error()
+	}
+	return message
+}
+
+func (e *AuthDeniedError) Unwrap() error {
+	return e.Err
+}
+
+// Identity is what an authenticator established about a client.
+type Identity struct {
+	Username    string
+	Groups      []string
+	Permissions *Permissions
+	MaxSessions *int
+	Session     *SessionSettings
+}
+
+// Authenticator decides whether a client may connect. It abstains when the
+// client is none of its business, and returns an error when its backend
+// could not answer. Along with a denial, the error tells why.
+type Authenticator interface {
+	Authenticate(request AuthRequest) (AuthResult, *Identity, error)
+}
+
+type namedAuthenticator struct {
+	name          string
+	authenticator Authenticator
+}
+
+type knownClient struct {
+	identity  *Identity
+	expiresAt time.Time
+}
+
+// AuthChain asks its authenticators in order until one allows or denies
+// the client. Clients are denied when all of them abstain. When an
+// authenticator fails, the policy decides: "closed" denies the client,
+// "open" allows it, and "known" allows it when it authenticated with the
+// same credentials within KnownTTL.
+type AuthChain struct {
+	Policy         string
+	KnownTTL       time.Duration
+	authenticators []namedAuthenticator
+	salt           []byte
+	known          map[string]knownClient
+	mutex          sync.Mutex
+}
+
+func NewAuthChain(policy string, knownTTL time.Duration) (*AuthChain, error) {
+	salt, err := newSalt()
+	if err != nil {
+		return nil, err
+	}
+	return &AuthChain{
+		Policy:   policy,
+		KnownTTL: knownTTL,
+		salt:     salt,
+		known:    make(map[string]knownClient),
+	}, nil
+}
+
+// Add appends an authenticator to the chain.
+func (c *AuthChain) Add(name string, authenticator Authenticator) {
+	c.authenticators = append(c.authenticators, namedAuthenticator{name: name, authenticator: authenticator})
+}
+
+// Authenticate returns the identity of an allowed client. Otherwise the
+// error is an *AuthDeniedError, or an *AuthFailedError when an authenticator
+// could not answer.
+func (c *AuthChain) Authenticate(request AuthRequest) (*Identity, error) {
+	for _, entry := range c.authenticators {
+		result, identity, err := entry.authenticator.Authenticate(request)
+		switch {
+		case result == AuthDeny:
+			return nil, &AuthDeniedError{Authenticator: entry.name, Err: err}
+		case err != nil:
+			return c.fail(entry.name, request, err)
+		case result == AuthAllow:
+			if identity == nil {
+				identity = &Identity{Username: request.Username}
+			}
+			c.remember(request, identity)
+			return identity, nil
+		}
+	}
+	return nil, &AuthDeniedError{}
+}
+
+// fail applies the policy when an authenticator could not answer.
+func (c *AuthChain) fail(name string, request AuthRequest, err error) (*Identity, error) {
+	switch c.Policy {
+	case AuthFailOpen:
+		slog.Warn("Authenticator failed, allowing client", "authenticator", name, "err", err, "client", request.ClientID)
+		return &Identity{Username: request.Username}, nil
+	case AuthFailKnown:
+		if identity, ok := c.recall(request); ok {
+			slog.Warn("Authenticator failed, allowing known client", "authenticator", name, "err", err, "client", request.ClientID)
+			return identity, nil
+		}
+	}
+	return nil, &AuthFailedError{Authenticator: name, Err: err}
+}
+
+func (c *AuthChain) knownKey(request AuthRequest) string {
+	return hashFields(c.salt, request.ClientID, request.Username, request.Password, request.CertFingerprint)
+}
+
+func (c *AuthChain) remember(request AuthRequest, identity *Identity) {
+	if c.Policy != AuthFailKnown {
+		return
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	now := time.Now()
+	if len(c.known) >= knownClientsMaxEntries {
+		for key, entry := range c.known {
+			if now.After(entry.expiresAt) {
+				delete(c.known, key)
+			}
+		}
+	}
+	c.known[c.knownKey(request)] = knownClient{identity: identity, expiresAt: now.Add(c.KnownTTL)}
+}
+
+func (c *AuthChain) recall(request AuthRequest) (*Identity, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	entry, ok := c.known[c.knownKey(request)]
+	if !ok || time.Now().After(entry.expiresAt) {
+		return nil, false
+	}
+	return entry.identity, true
+}
+
+// HTTPAuthenticator asks the authorize endpoint. 401 and 403 deny the
+// client, any other unsuccessful status code and timeouts are failures, so a
+// misconfigured endpoint is not taken for wrong credentials.
+type HTTPAuthenticator struct {
+	Client *HTTPClient
+}
+
+func (a *HTTPAuthenticator) Authenticate(request AuthRequest) (AuthResult, *Identity, error) {
+	res, err := a.Client.Authorize(request)
+	if err != nil {
+		var authErr *AuthError
+		if errors.As(err, &authErr) && authErr.Denied() {
+			return AuthDeny, nil, authErr
+		}
+		return AuthAbstain, nil, err
+	}
+
+	identity := &Identity{Username: request.Username, MaxSessions: res.MaxSessions}
+	if !res.Permissions.IsEmpty() {
+		identity.Permissions = &res.Permissions
+	}
+	if !res.SessionSettings.IsEmpty() {
+		err := res.SessionSettings.Validate()
+		if err != nil {
+			return AuthDeny, nil, fmt.Errorf("invalid session settings: %w", err)
+		}
+		identity.Session = &res.SessionSettings
+	}
+	return AuthAllow, identity, nil
+}
+
+// ClientCertAuthenticator allows clients presenting a client certificate
+// verified by the TLS listener. The username is built from the certificate
+// with UsernameTemplate, e.g. "{cn}". Revoked certificates are denied.
+type ClientCertAuthenticator struct {
+	UsernameTemplate string
+	Revoked          *RevocationList
+}
+
+func (a *ClientCertAuthenticator) Authenticate(request AuthRequest) (AuthResult, *Identity, error) {
+	if request.Certificate == nil {
+		return AuthAbstain, nil, nil
+	}
+	if a.Revoked != nil && a.Revoked.Revoked(request.CertFingerprint) {
+		slog.Info("Revoked client certificate", "client", request.ClientID, "fingerprint", request.CertFingerprint)
+		return AuthDeny, nil, nil
+	}
+
+	username, err := ExpandCertTemplate(a.UsernameTemplate, request.Certificate)
+	if err != nil {
+		slog.Info("No username in client certificate", "err", err, "client", request.ClientID)
+		return AuthDeny, nil, nil
+	}
+	return AuthAllow, &Identity{Username: username}, nil
+}
+
+// AnonymousAuthenticator allows clients sending neither a username nor a
+// password.
+type AnonymousAuthenticator struct{}
+
+func (a *AnonymousAuthenticator) Authenticate(request AuthRequest) (AuthResult, *Identity, error) {
+	if request.Username != "" || request.Password != "" {
+		return AuthAbstain, nil, nil
+	}
+	return AuthAllow, &Identity{}, nil
+}
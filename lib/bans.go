@@ -0,0 +1,234 @@
+package lib
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+)
+
+// What bans apply to.
+const (
+	BanUsername = "username"
+	BanClientID = "client_id"
+	BanIP       = "ip"
+)
+
+// Ban blocks the clients with a username, a client ID, or an IP address in
+// a CIDR until it expires. Bans without expiry are permanent.
+type Ban struct {
+	Kind      string     `json:"kind"`
+	Value     string     `json:"value"`
+	Reason    string     `json:"reason,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	prefix    netip.Prefix
+}
+
+// Parse checks the ban and prepares the matching of IP bans, which take a
+// single address or a CIDR.
+func (b *Ban) Parse() error {
+	if b.Value == "" {
+		return errors.New("ban value is empty")
+	}
+
+	switch b.Kind {
+	case BanUsername, BanClientID:
+		return nil
+	case BanIP:
+		if addr, err := netip.ParseAddr(b.Value); err == nil {
+			b.prefix = netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen())
+			return nil
+		}
+		prefix, err := netip.ParsePrefix(b.Value)
+		if err != nil {
+			return fmt.Errorf("invalid IP address or CIDR %q", b.Value)
+		}
+		b.prefix = prefix.Masked()
+		return nil
+	default:
+		return fmt.Errorf("unknown ban kind %q", b.Kind)
+	}
+}
+
+// Matches reports whether the ban applies to the client.
+func (b *Ban) Matches(clientID string, username string, remoteAddr string) bool {
+	switch b.Kind {
+	case BanUsername:
+		return username == b.Value
+	case BanClientID:
+		return clientID == b.Value
+	case BanIP:
+		host, _, err := net.SplitHostPort(remoteAddr)
+		if err != nil {
+			host = remoteAddr
+		}
+		addr, err := netip.ParseAddr(host)
+		return err == nil && b.prefix.Contains(addr.Unmap())
+	}
+	return false
+}
+
+func (b *Ban) expired(now time.Time) bool {
+	return b.ExpiresAt != nil && now.After(*b.ExpiresAt)
+}
+
+// BanList holds the bans, saved as JSON to Path on every change. Without a
+// path they are only kept in memory.
+type BanList struct {
+	Path  string
+	bans  []Ban
+	mutex sync.RWMutex
+}
+
+// NewBanList reads the bans and makes sure they can be saved, so that an
+// unwritable path fails at startup rather than at the first ban.
+func NewBanList(path string) (*BanList, error) {
+	list := &BanList{Path: path}
+	err := list.Reload()
+	if err != nil {
+		return nil, err
+	}
+	err = list.checkWritable()
+	if err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+// checkWritable creates and removes a file next to the bans file, the way
+// it is saved.
+func (l *BanList) checkWritable() error {
+	if l.Path == "" {
+		return nil
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(l.Path), "."+filepath.Base(l.Path)+"-*")
+	if err != nil {
+		return fmt.Errorf("bans file cannot be saved: %w", err)
+	}
+	tmp.Close()
+	return os.Remove(tmp.Name())
+}
+
+// Reload reads the file again. A missing file holds no bans.
+func (l *BanList) Reload() error {
+	if l.Path == "" {
+		return nil
+	}
+
+	data, err := os.ReadFile(l.Path)
+	if errors.Is(err, os.ErrNotExist) {
+		data = []byte("[]")
+	} else if err != nil {
+		return fmt.Errorf("failed to read bans file: %w", err)
+	}
+
+	bans := []Ban{}
+	err = json.Unmarshal(data, &bans)
+	if err != nil {
+		return fmt.Errorf("invalid bans file: %w", err)
+	}
+	for i := range bans {
+		err := bans[i].Parse()
+		if err != nil {
+			return fmt.Errorf("invalid bans file: %w", err)
+		}
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.bans = bans
+	return nil
+}
+
+// Add saves a ban, replacing the one with the same kind and value.
+func (l *BanList) Add(ban Ban) error {
+	err := ban.Parse()
+	if err != nil {
+		return err
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	bans := slices.DeleteFunc(l.active(), func(b Ban) bool {
+		return b.Kind == ban.Kind && b.Value == ban.Value
+	})
+	return l.save(append(bans, ban))
+}
+
+// Remove lifts the ban with the kind and value, and reports whether there
+// was one.
+func (l *BanList) Remove(kind string, value string) (bool, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	bans := l.active()
+	count := len(bans)
+	bans = slices.DeleteFunc(bans, func(b Ban) bool {
+		return b.Kind == kind && b.Value == value
+	})
+	if len(bans) == count {
+		return false, nil
+	}
+	return true, l.save(bans)
+}
+
+// List returns the bans that did not expire.
+func (l *BanList) List() []Ban {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+
+	return l.active()
+}
+
+// Match returns the ban applying to the client, if any.
+func (l *BanList) Match(clientID string, username string, remoteAddr string) (Ban, bool) {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+
+	now := time.Now()
+	for _, ban := range l.bans {
+		if !ban.expired(now) && ban.Matches(clientID, username, remoteAddr) {
+			return ban, true
+		}
+	}
+	return Ban{}, false
+}
+
+// active returns a copy of the bans that did not expire.
+func (l *BanList) active() []Ban {
+	now := time.Now()
+	bans := []Ban{}
+	for _, ban := range l.bans {
+		if !ban.expired(now) {
+			bans = append(bans, ban)
+		}
+	}
+	return bans
+}
+
+// save writes the bans to the file and keeps them when it succeeds.
+func (l *BanList) save(bans []Ban) error {
+	if l.Path != "" {
+		data, err := json.MarshalIndent(bans, "", "  ")
+		if err != nil {
+			return err
+		}
+		err = writeFileAtomic(l.Path, append(data, '\n'))
+		if err != nil {
+			return fmt.Errorf("failed to save bans: %w", err)
+		}
+	}
+
+	l.bans = bans
+	return nil
+}
@@ -0,0 +1,120 @@
+package lib
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"math/big"
+	"net"
+	"regexp"
+	"strings"
+)
+
+// certPlaceholderPattern matches {name} placeholders of username templates.
+var certPlaceholderPattern = regexp.MustCompile(`\{([a-z_]+)\}`)
+
+// CertificateIdentity is the part of a client certificate shown in /clients
+// and usable in ACL placeholders and forwarded headers.
+type CertificateIdentity struct {
+	Subject     string `json:"subject"`
+	CommonName  string `json:"common_name"`
+	Fingerprint string `json:"fingerprint"`
+}
+
+func NewCertificateIdentity(cert *x509.Certificate) *CertificateIdentity {
+	return &CertificateIdentity{
+		Subject:     cert.Subject.String(),
+		CommonName:  cert.Subject.CommonName,
+		Fingerprint: Fingerprint(cert),
+	}
+}
+
+// PeerCertificate returns the verified client certificate of a TLS
+// connection, or nil when there is none. Connections wrapping the TLS one,
+// like WebSocket connections, are unwrapped.
+func PeerCertificate(conn net.Conn) *x509.Certificate {
+	tlsConn, ok := conn.(*tls.Conn)
+	for !ok {
+		wrapper, isWrapper := conn.(interface{ NetConn() net.Conn })
+		if !isWrapper {
+			return nil
+		}
+		conn = wrapper.NetConn()
+		tlsConn, ok = conn.(*tls.Conn)
+	}
+	state := tlsConn.ConnectionState()
+	if len(state.PeerCertificates) == 0 {
+		return nil
+	}
+	return state.PeerCertificates[0]
+}
+
+// Fingerprint returns the hex encoded SHA-256 digest of the certificate.
+func Fingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	return hex.EncodeToString(sum[:])
+}
+
+// certFields returns the values available to username templates. Fields
+// with several values use the first one.
+func certFields(cert *x509.Certificate) map[string]string {
+	first := func(values []string) string {
+		if len(values) == 0 {
+			return ""
+		}
+		return values[0]
+	}
+
+	uri := ""
+	if len(cert.URIs) > 0 {
+		uri = cert.URIs[0].String()
+	}
+
+	return map[string]string{
+		"cn":          cert.Subject.CommonName,
+		"o":           first(cert.Subject.Organization),
+		"ou":          first(cert.Subject.OrganizationalUnit),
+		"serial":      cert.SerialNumber.String(),
+		"fingerprint": Fingerprint(cert),
+		"san_dns":     first(cert.DNSNames),
+		"san_email":   first(cert.EmailAddresses),
+		"san_uri":     uri,
+	}
+}
+
+// ExpandCertTemplate builds a username from the certificate, replacing
+// placeholders such as {cn} or {san_dns}. It fails when a placeholder is
+// unknown or empty for this certificate.
+func ExpandCertTemplate(template string, cert *x509.Certificate) (string, error) {
+	fields := certFields(cert)
+
+	var err error
+	result := certPlaceholderPattern.ReplaceAllStringFunc(template, func(match string) string {
+		name := strings.Trim(match, "{}")
+		value, ok := fields[name]
+		if !ok {
+			err = fmt.Errorf("unknown placeholder %s", match)
+		} else if value == "" && err == nil {
+			err = fmt.Errorf("certificate has no value for %s", match)
+		}
+		return value
+	})
+	if err != nil {
+		return "", err
+	}
+	return result, nil
+}
+
+// ValidateCertTemplate checks that a username template only uses known
+// placeholders.
+func ValidateCertTemplate(template string) error {
+	fields := certFields(&x509.Certificate{SerialNumber: new(big.Int)})
+	for _, match := range certPlaceholderPattern.FindAllStringSubmatch(template, -1) {
+		if _, ok := fields[match[1]]; !ok {
+			return fmt.Errorf("unknown placeholder %s", match[0])
+		}
+	}
+	return nil
+}
@@ -1,20 +1,198 @@
 package lib
 
-import "time"
+import (
+	"maps"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+)
 
 type Client struct {
-	ID             string           `json:"id"`
-	Username       string           `json:"username"`
-	Subscribtions  []string         `json:"subscriptions"`
-	Publications   map[string]int64 `json:"publications"`
-	ConnectedAt    time.Time        `json:"connected_at"`
-	LastActivityAt time.Time        `json:"last_activity_at"`
+	ID             string               `json:"id"`
+	Username       string               `json:"username"`
+	Subscribtions  []Subscription       `json:"subscriptions"`
+	Publications   map[string]int64     `json:"publications"`
+	ConnectedAt    time.Time            `json:"connected_at"`
+	LastActivityAt time.Time            `json:"last_activity_at"`
+	Listener       string               `json:"listener"`
+	RemoteAddr     string               `json:"remote_addr"`
+	Permissions    *Permissions         `json:"permissions,omitempty"`
+	Groups         []string             `json:"groups,omitempty"`
+	Certificate    *CertificateIdentity `json:"certificate,omitempty"`
+	MaxSessions    *int                 `json:"max_sessions,omitempty"`
+	Session        *SessionSettings     `json:"session,omitempty"`
+	Conn           net.Conn             `json:"-"`
+	Traffic        *Traffic             `json:"-"`
+	Pending        *PendingMessages     `json:"-"`
+}
+
+// Subscription is a subscription granted to a client, with the QoS it was
+// granted and the group of shared subscriptions.
+type Subscription struct {
+	Filter            string `json:"filter"`
+	QoS               byte   `json:"qos"`
+	NoLocal           bool   `json:"no_local,omitempty"`
+	RetainAsPublished bool   `json:"retain_as_published,omitempty"`
+	RetainHandling    byte   `json:"retain_handling,omitempty"`
+	Group             string `json:"group,omitempty"`
+}
+
+func NewSubscription(sub packets.Subscription, qos byte) Subscription {
+	subscription := Subscription{
+		Filter:            sub.Filter,
+		QoS:               qos,
+		NoLocal:           sub.NoLocal,
+		RetainAsPublished: sub.RetainAsPublished,
+		RetainHandling:    sub.RetainHandling,
+	}
+	if rest, ok := strings.CutPrefix(sub.Filter, sharePrefix); ok {
+		subscription.Group, _, _ = strings.Cut(rest, "/")
+	}
+	return subscription
+}
+
+// clone copies the record, so that it can be read without holding the lock
+// of the store.
+func (c *Client) clone() *Client {
+	clone := *c
+	clone.Subscribtions = slices.Clone(c.Subscribtions)
+	clone.Publications = maps.Clone(c.Publications)
+	return &clone
+}
+
+// subscription returns the index of the subscription to the filter, or -1.
+func (c *Client) subscription(filter string) int {
+	return slices.IndexFunc(c.Subscribtions, func(sub Subscription) bool {
+		return sub.Filter == filter
+	})
+}
+
+func (c *Client) setSubscription(sub Subscription) {
+	if i := c.subscription(sub.Filter); i >= 0 {
+		c.Subscribtions[i] = sub
+		return
+	}
+	c.Subscribtions = append(c.Subscribtions, sub)
+}
+
+// Traffic counts the bytes exchanged with a client.
+type Traffic struct {
+	Received atomic.Int64
+	Sent     atomic.Int64
+}
+
+// PendingMessages tracks the packet IDs of the QoS 1 and 2 messages queued
+// for a client and not written to it yet. Mochi drops a message without
+// telling its packet ID when the queue is full, so only the IDs still
+// inflight are counted.
+type PendingMessages struct {
+	ids   map[uint16]struct{}
+	mutex sync.Mutex
 }
 
-func NewClient(id string, username string) *Client {
-	client := &Client{ID: id, Username: username}
+func (p *PendingMessages) Queued(id uint16) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.ids == nil {
+		p.ids = make(map[uint16]struct{})
+	}
+	p.ids[id] = struct{}{}
+}
+
+func (p *PendingMessages) Written(id uint16) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	delete(p.ids, id)
+}
+
+// Len returns the count of pending messages, forgetting the ones no longer
+// inflight.
+func (p *PendingMessages) Len(inflight *mqtt.Inflight) int {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	for id := range p.ids {
+		if _, ok := inflight.Get(id); !ok {
+			delete(p.ids, id)
+		}
+	}
+	return len(p.ids)
+}
+
+func NewClient(id string, username string, listener string, remoteAddr string) *Client {
+	client := &Client{ID: id, Username: username, Listener: listener, RemoteAddr: remoteAddr}
 	client.Publications = make(map[string]int64)
+	client.Traffic = &Traffic{}
+	client.Pending = &PendingMessages{}
 	client.ConnectedAt = time.Now()
 	client.LastActivityAt = time.Now()
 	return client
 }
+
+// ClientDetails merges the record of a client with the live state of its
+// MQTT session. Sessions kept after their client disconnected have no
+// record.
+type ClientDetails struct {
+	*Client
+	ID              string       `json:"id"`
+	RemoteAddr      string       `json:"remote_addr"`
+	Connected       bool         `json:"connected"`
+	ProtocolVersion byte         `json:"protocol_version"`
+	Keepalive       uint16       `json:"keepalive"`
+	CleanStart      bool         `json:"clean_start"`
+	SessionExpiry   uint32       `json:"session_expiry"`
+	Inflight        int          `json:"inflight"`
+	Pending         int          `json:"pending"`
+	Will            *WillDetails `json:"will,omitempty"`
+	BytesReceived   int64        `json:"bytes_received"`
+	BytesSent       int64        `json:"bytes_sent"`
+}
+
+// WillDetails is the will message of a session. The payload is encoded in
+// base64.
+type WillDetails struct {
+	Topic         string `json:"topic"`
+	Payload       []byte `json:"payload"`
+	QoS           byte   `json:"qos"`
+	Retain        bool   `json:"retain"`
+	DelayInterval uint32 `json:"delay_interval"`
+}
+
+func NewClientDetails(record *Client, cl *mqtt.Client) *ClientDetails {
+	details := &ClientDetails{
+		Client:          record,
+		ID:              cl.ID,
+		RemoteAddr:      cl.Net.Remote,
+		Connected:       !cl.Closed(),
+		ProtocolVersion: cl.Properties.ProtocolVersion,
+		Keepalive:       cl.State.Keepalive,
+		CleanStart:      cl.Properties.Clean,
+		SessionExpiry:   cl.Properties.Props.SessionExpiryInterval,
+		Inflight:        cl.State.Inflight.Len(),
+	}
+	if will := cl.Properties.Will; will.Flag > 0 {
+		details.Will = &WillDetails{
+			Topic:         will.TopicName,
+			Payload:       will.Payload,
+			QoS:           will.Qos,
+			Retain:        will.Retain,
+			DelayInterval: will.WillDelayInterval,
+		}
+	}
+	if record != nil && record.Traffic != nil {
+		details.BytesReceived = record.Traffic.Received.Load()
+		details.BytesSent = record.Traffic.Sent.Load()
+	}
+	if record != nil && record.Pending != nil {
+		details.Pending = record.Pending.Len(cl.State.Inflight)
+	}
+	return details
+}
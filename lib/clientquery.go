@@ -0,0 +1,144 @@
+package lib
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Orders of the clients returned by a query. Ties are broken by client ID.
+const (
+	SortID             = "id"
+	SortUsername       = "username"
+	SortConnectedAt    = "connected_at"
+	SortLastActivityAt = "last_activity_at"
+)
+
+// sortTimeFormat has a fixed width, so that times in UTC sort as strings.
+const sortTimeFormat = "2006-01-02T15:04:05.000000000Z"
+
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// ClientQuery selects, orders and pages the records of connected clients.
+// Empty filters match every client, and a zero Limit returns them all.
+type ClientQuery struct {
+	Username      string
+	IDPrefix      string
+	Subscription  string
+	Listener      string
+	InactiveSince time.Time
+	Sort          string
+	Descending    bool
+	Cursor        string
+	Limit         int
+}
+
+// Validate checks the sort order, the limit and the cursor.
+func (q *ClientQuery) Validate() error {
+	switch q.Sort {
+	case "", SortID, SortUsername, SortConnectedAt, SortLastActivityAt:
+	default:
+		return fmt.Errorf("unknown sort order %q", q.Sort)
+	}
+	if q.Limit < 0 {
+		return errors.New("limit must not be negative")
+	}
+	_, err := q.after()
+	return err
+}
+
+func (q *ClientQuery) matches(client *Client) bool {
+	if q.Username != "" && client.Username != q.Username {
+		return false
+	}
+	if !strings.HasPrefix(client.ID, q.IDPrefix) {
+		return false
+	}
+	if q.Listener != "" && client.Listener != q.Listener {
+		return false
+	}
+	if q.Subscription != "" && client.subscription(q.Subscription) < 0 {
+		return false
+	}
+	return q.InactiveSince.IsZero() || client.LastActivityAt.Before(q.InactiveSince)
+}
+
+// key returns the position of the client in the sort order.
+func (q *ClientQuery) key(client *Client) string {
+	switch q.Sort {
+	case SortUsername:
+		return client.Username + "\x00" + client.ID
+	case SortConnectedAt:
+		return client.ConnectedAt.UTC().Format(sortTimeFormat) + "\x00" + client.ID
+	case SortLastActivityAt:
+		return client.LastActivityAt.UTC().Format(sortTimeFormat) + "\x00" + client.ID
+	default:
+		return client.ID
+	}
+}
+
+// after returns the key of the last client of the previous page.
+func (q *ClientQuery) after() (string, error) {
+	if q.Cursor == "" {
+		return "", nil
+	}
+	key, err := base64.RawURLEncoding.DecodeString(q.Cursor)
+	if err != nil {
+		return "", ErrInvalidCursor
+	}
+	return string(key), nil
+}
+
+// Query returns copies of the records matching the query, and the cursor of
+// the next page when there is one. The lock is only held to select the
+// records and to copy those of the page.
+func (s *ClientStore) Query(query ClientQuery) ([]*Client, string, error) {
+	after, err := query.after()
+	if err != nil {
+		return nil, "", err
+	}
+
+	type entry struct {
+		key    string
+		client *Client
+	}
+	entries := []entry{}
+
+	s.mutex.RLock()
+	for _, client := range s.clients {
+		if !query.matches(client) {
+			continue
+		}
+		key := query.key(client)
+		if after != "" && (!query.Descending && key <= after || query.Descending && key >= after) {
+			continue
+		}
+		entries = append(entries, entry{key, client})
+	}
+	s.mutex.RUnlock()
+
+	slices.SortFunc(entries, func(a, b entry) int {
+		if query.Descending {
+			return strings.Compare(b.key, a.key)
+		}
+		return strings.Compare(a.key, b.key)
+	})
+
+	next := ""
+	if query.Limit > 0 && len(entries) > query.Limit {
+		entries = entries[:query.Limit]
+		next = base64.RawURLEncoding.EncodeToString([]byte(entries[len(entries)-1].key))
+	}
+
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	clients := make([]*Client, 0, len(entries))
+	for _, entry := range entries {
+		clients = append(clients, entry.client.clone())
+	}
+	return clients, next, nil
+}
@@ -1,17 +1,46 @@
 package lib
 
 import (
-	"encoding/json"
+	"errors"
+	"net"
+	"slices"
 	"sync"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 )
 
+// Policies applied when a username reaches its maximum number of sessions.
+const (
+	SessionLimitRejectNew  = "reject-new"
+	SessionLimitKickOldest = "kick-oldest"
+)
+
+// Policies applied when a client connects with the client ID of a connected
+// one.
+const (
+	TakeoverAllow        = "allow"
+	TakeoverSameUsername = "same-username"
+	TakeoverReject       = "reject"
+)
+
+var (
+	ErrTooManySessions = errors.New("too many sessions for the username")
+	ErrClientIDInUse   = errors.New("client ID in use")
+)
+
+// ClientStore keeps the records of the connected clients. It limits the
+// sessions of a username to MaxSessions, or to the MaxSessions of the
+// client when set, 0 meaning no limit, and applies the SessionPolicy
+// beyond. Taking over the session of a connected client ID is subject to
+// the Takeover policy.
 type ClientStore struct {
-	clients map[string]*Client
-	mutex   sync.RWMutex
-	metrics *Metrics
+	MaxSessions   int
+	SessionPolicy string
+	Takeover      string
+	clients       map[string]*Client
+	mutex         sync.RWMutex
+	metrics       *Metrics
 }
 
 func NewClientStore(metrics *Metrics) *ClientStore {
@@ -21,26 +50,151 @@ func NewClientStore(metrics *Metrics) *ClientStore {
 	return hub
 }
 
-func (s *ClientStore) Enter(id string, username string) {
+// Admit checks that a connecting client may take over the session of its
+// client ID and fits in the session limit of its username. It removes and
+// returns the records of the sessions to disconnect to make room for it, or
+// returns an error when the client must be refused. The client itself is
+// only recorded by Enter, once its session is established.
+func (s *ClientStore) Admit(client *Client) ([]*Client, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.admit(client)
+}
+
+// Enter records a client whose session is established, replacing the record
+// of a session it took over. The checks of Admit are applied again, in case
+// another session of the username was established in the meantime.
+func (s *ClientStore) Enter(client *Client) ([]*Client, error) {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
 
-	_, known := s.clients[id]
-	if !known {
-		s.clients[id] = NewClient(id, username)
-		s.metrics.sessionGauge.Inc()
+	evicted, err := s.admit(client)
+	if err != nil {
+		return nil, err
+	}
+
+	if existing, known := s.clients[client.ID]; known {
+		s.remove(existing)
+	}
+	s.clients[client.ID] = client
+	labels := prometheus.Labels{"listener": client.Listener}
+	s.metrics.sessionGauge.With(labels).Inc()
+	return evicted, nil
+}
+
+func (s *ClientStore) admit(client *Client) ([]*Client, error) {
+	existing, known := s.clients[client.ID]
+	if known {
+		switch s.Takeover {
+		case TakeoverReject:
+			s.countLimit("client_id", "reject")
+			return nil, ErrClientIDInUse
+		case TakeoverSameUsername:
+			if existing.Username != client.Username {
+				s.countLimit("client_id", "reject")
+				return nil, ErrClientIDInUse
+			}
+		}
+	}
+
+	evicted, err := s.makeRoom(client)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, old := range evicted {
+		s.remove(old)
 	}
+	return evicted, nil
+}
+
+// makeRoom returns the oldest sessions of the username to disconnect so the
+// client fits in its limit, or an error when it must be refused instead.
+func (s *ClientStore) makeRoom(client *Client) ([]*Client, error) {
+	limit := s.MaxSessions
+	if client.MaxSessions != nil {
+		limit = *client.MaxSessions
+	}
+	if limit <= 0 || client.Username == "" {
+		return nil, nil
+	}
+
+	sessions := []*Client{}
+	for _, other := range s.clients {
+		if other.Username == client.Username && other.ID != client.ID {
+			sessions = append(sessions, other)
+		}
+	}
+	if len(sessions) < limit {
+		return nil, nil
+	}
+
+	if s.SessionPolicy != SessionLimitKickOldest {
+		s.countLimit("max_sessions", "reject")
+		return nil, ErrTooManySessions
+	}
+
+	slices.SortFunc(sessions, func(a, b *Client) int {
+		return a.ConnectedAt.Compare(b.ConnectedAt)
+	})
+	evicted := sessions[:len(sessions)-limit+1]
+	for range evicted {
+		s.countLimit("max_sessions", "kick")
+	}
+	return evicted, nil
+}
+
+func (s *ClientStore) remove(client *Client) {
+	delete(s.clients, client.ID)
+	labels := prometheus.Labels{"listener": client.Listener}
+	s.metrics.sessionGauge.With(labels).Dec()
+}
+
+func (s *ClientStore) countLimit(reason string, action string) {
+	labels := prometheus.Labels{"reason": reason, "action": action}
+	s.metrics.sessionLimitCounter.With(labels).Inc()
+}
+
+// Get returns the record of a connected client.
+func (s *ClientStore) Get(id string) (*Client, bool) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	client, ok := s.clients[id]
+	return client, ok
 }
 
-func (s *ClientStore) Leave(id string) {
+// Snapshot returns a copy of the record of a connected client, safe to
+// read while the client keeps publishing.
+func (s *ClientStore) Snapshot(id string) (*Client, bool) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	client, ok := s.clients[id]
+	if !ok {
+		return nil, false
+	}
+	return client.clone(), true
+}
+
+// Leave removes the record of the client connected over conn. The record of
+// a session that took over the client ID is kept.
+func (s *ClientStore) Leave(id string, conn net.Conn) {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
 
-	delete(s.clients, id)
-	s.metrics.sessionGauge.Dec()
+	client, known := s.clients[id]
+	if !known || client.Conn != conn {
+		return
+	}
+
+	s.remove(client)
 }
 
-func (s *ClientStore) Subscribe(id string, topics []string) {
+// Subscribe records the subscriptions granted to a client, replacing those
+// with the same filters.
+func (s *ClientStore) Subscribe(id string, subs []Subscription) {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
 
@@ -49,25 +203,18 @@ func (s *ClientStore) Subscribe(id string, topics []string) {
 		return
 	}
 
-	for _, topic := range topics {
-		found := false
-		for _, sub := range client.Subscribtions {
-			if sub == topic {
-				found = true
-				break
-			}
-		}
-		if !found {
-			client.Subscribtions = append(client.Subscribtions, topic)
-		}
-		labels := prometheus.Labels{"topic": topic}
+	for _, sub := range subs {
+		client.setSubscription(sub)
+		labels := prometheus.Labels{"topic": sub.Filter}
 		s.metrics.subscribeCounter.With(labels).Inc()
 	}
 
 	client.LastActivityAt = time.Now()
 }
 
-func (s *ClientStore) Publish(id string, topic string) {
+// RestoreSubscriptions records the subscriptions of a session resumed by a
+// client, without counting them as new subscriptions.
+func (s *ClientStore) RestoreSubscriptions(id string, subs []Subscription) {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
 
@@ -76,22 +223,40 @@ func (s *ClientStore) Publish(id string, topic string) {
 		return
 	}
 
-	value := client.Publications[topic]
-	client.Publications[topic] = value + 1
-	client.LastActivityAt = time.Now()
+	for _, sub := range subs {
+		client.setSubscription(sub)
+	}
+}
 
-	labels := prometheus.Labels{"topic": topic}
-	s.metrics.publishCounter.With(labels).Inc()
+// Unsubscribe forgets the subscriptions of a client to the filters.
+func (s *ClientStore) Unsubscribe(id string, filters []string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	client, ok := s.clients[id]
+	if !ok {
+		return
+	}
+
+	client.Subscribtions = slices.DeleteFunc(client.Subscribtions, func(sub Subscription) bool {
+		return slices.Contains(filters, sub.Filter)
+	})
+	client.LastActivityAt = time.Now()
 }
 
-func (s *ClientStore) Export() ([]byte, error) {
-	s.mutex.RLock()
-	defer s.mutex.RUnlock()
+func (s *ClientStore) Publish(id string, topic string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
 
-	clients := make([]*Client, 0, len(s.clients))
-	for _, client := range s.clients {
-		clients = append(clients, client)
+	client, ok := s.clients[id]
+	if !ok {
+		return
 	}
 
-	return json.Marshal(clients)
+	value := client.Publications[topic]
+	client.Publications[topic] = value + 1
+	client.LastActivityAt = time.Now()
+
+	labels := prometheus.Labels{"topic": topic, "listener": client.Listener}
+	s.metrics.publishCounter.With(labels).Inc()
 }
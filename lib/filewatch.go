@@ -0,0 +1,89 @@
+package lib
+
+import (
+	"log/slog"
+	"maps"
+	"os"
+	"sync"
+	"time"
+)
+
+// fileWatcher remembers the modification times of the files a source was
+// read from, so that it is only reloaded when one of them changes.
+type fileWatcher struct {
+	paths    []string
+	modTimes map[string]time.Time
+	mutex    sync.Mutex
+}
+
+// newFileWatcher watches the paths, empty ones left out.
+func newFileWatcher(paths ...string) *fileWatcher {
+	watcher := &fileWatcher{}
+	for _, path := range paths {
+		if path != "" {
+			watcher.paths = append(watcher.paths, path)
+		}
+	}
+	return watcher
+}
+
+// stat returns the current modification times of the files. Missing files
+// are left out. It is called before reading the files, so that a change
+// made while they are read is seen by the next check.
+func (w *fileWatcher) stat() map[string]time.Time {
+	modTimes := make(map[string]time.Time)
+	for _, path := range w.paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+		modTimes[path] = info.ModTime()
+	}
+	return modTimes
+}
+
+// loaded records the modification times of the files that were read.
+func (w *fileWatcher) loaded(modTimes map[string]time.Time) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	w.modTimes = modTimes
+}
+
+// changed reports whether a file was modified, created or removed since it
+// was last read.
+func (w *fileWatcher) changed() bool {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	return !maps.Equal(w.stat(), w.modTimes)
+}
+
+// watchFiles calls reload every interval, when changed reports a change or
+// every time when changed is nil, until stop is closed. A failed reload is
+// logged and retried at the next tick.
+func watchFiles(interval time.Duration, stop <-chan struct{}, changed func() bool, reload func() error, name string, args ...any) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			if changed != nil && !changed() {
+				continue
+			}
+			err := reload()
+			if err != nil {
+				slog.Error("Failed to reload "+name, append([]any{"err", err}, args...)...)
+				continue
+			}
+			if changed == nil {
+				slog.Debug("Reloaded "+name, args...)
+			} else {
+				slog.Info("Reloaded "+name, args...)
+			}
+		}
+	}
+}
@@ -2,10 +2,16 @@ package lib
 
 import (
 	"bytes"
+	"crypto/x509"
+	"encoding/json"
 	"fmt"
+	"io"
+	"mime"
+	"net"
 	"net/http"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
@@ -14,52 +20,175 @@ import (
 const clientTimeout = time.Duration(5) * time.Second
 
 type HTTPClient struct {
-	ContentType  string
-	TopicHeader  string
-	AuthorizeURL string
-	Metrics      *Metrics
+	ContentType     string
+	TopicHeader     string
+	AuthorizeURL    string
+	AuthorizeFormat string
+	Cache           *AuthCache
+	Metrics         *Metrics
+	mutex           sync.RWMutex
 }
 
-func NewHTTPClient(contentType string, topicHeader string, authorizeURL string, metrics *Metrics) *HTTPClient {
+func NewHTTPClient(contentType string, topicHeader string, authorizeURL string, authorizeFormat string, metrics *Metrics) *HTTPClient {
 	return &HTTPClient{
-		ContentType:  contentType,
-		TopicHeader:  topicHeader,
-		AuthorizeURL: authorizeURL,
-		Metrics:      metrics,
+		ContentType:     contentType,
+		TopicHeader:     topicHeader,
+		AuthorizeURL:    authorizeURL,
+		AuthorizeFormat: authorizeFormat,
+		Metrics:         metrics,
 	}
 }
 
-func (c *HTTPClient) Authorize(username string, password string) (bool, error) {
+// SetAuthorizeURL changes the authorize endpoint. The cached answers are
+// flushed when it changed, since they came from the previous one.
+func (c *HTTPClient) SetAuthorizeURL(authorizeURL string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if authorizeURL == c.AuthorizeURL {
+		return
+	}
+	c.AuthorizeURL = authorizeURL
+	if c.Cache != nil {
+		c.Cache.Flush()
+	}
+}
+
+const (
+	AuthorizeFormatBasic   = "basic"
+	AuthorizeFormatJSON    = "json"
+	AuthorizeFormatHeaders = "headers"
+)
+
+// AuthRequest describes a client trying to connect.
+type AuthRequest struct {
+	ClientID        string `json:"client_id"`
+	Username        string `json:"username"`
+	Password        string `json:"password"`
+	RemoteAddr      string `json:"remote_addr"`
+	Listener        string `json:"listener"`
+	ProtocolVersion byte   `json:"protocol_version"`
+	CleanStart      bool   `json:"clean_start"`
+	CertSubject     string `json:"cert_subject,omitempty"`
+	CertFingerprint string `json:"cert_fingerprint,omitempty"`
+
+	// Certificate is the verified client certificate, if any.
+	Certificate *x509.Certificate `json:"-"`
+}
+
+// AuthResponse is the optional JSON body of a successful authorize response.
+type AuthResponse struct {
+	Permissions
+	SessionSettings
+	// Reason is sent to MQTT 5 clients that are denied.
+	Reason string `json:"reason,omitempty"`
+	// MaxSessions overrides the maximum number of sessions of the username.
+	MaxSessions *int `json:"max_sessions,omitempty"`
+}
+
+// Authorize asks the authorize URL whether the client may connect. The
+// credentials are always sent with Basic Auth and the client IP address in
+// the X-Forwarded-For header. Depending on AuthorizeFormat, the other
+// details are sent as a JSON body or as X-MQTT-* headers. A JSON body in
+// the response is parsed into the returned AuthResponse. Answers are served
+// from the cache when one is set.
+func (c *HTTPClient) Authorize(request AuthRequest) (*AuthResponse, error) {
+	if c.Cache == nil {
+		response, _, err := c.authorize(request)
+		return response, err
+	}
+
+	key := c.Cache.Key(request)
+	if response, err, ok := c.Cache.Get(key); ok {
+		return response, err
+	}
+
+	response, cacheControl, err := c.authorize(request)
+	c.Cache.Store(key, response, err, cacheControl)
+	return response, err
+}
+
+// authorize posts the request and also returns the Cache-Control header
+// of the answer.
+func (c *HTTPClient) authorize(request AuthRequest) (*AuthResponse, string, error) {
+	c.mutex.RLock()
+	authorizeURL := c.AuthorizeURL
+	c.mutex.RUnlock()
+
 	client := &http.Client{Timeout: clientTimeout}
 
-	req, err := http.NewRequest("POST", c.AuthorizeURL, nil)
+	var body io.Reader
+	if c.AuthorizeFormat == AuthorizeFormatJSON {
+		data, err := json.Marshal(request)
+		if err != nil {
+			return nil, "", err
+		}
+		body = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequest("POST", authorizeURL, body)
 	if err != nil {
-		return false, err
+		return nil, "", err
+	}
+
+	req.SetBasicAuth(request.Username, request.Password)
+	if host, _, err := net.SplitHostPort(request.RemoteAddr); err == nil {
+		req.Header.Set("X-Forwarded-For", host)
 	}
 
-	req.SetBasicAuth(username, password)
+	switch c.AuthorizeFormat {
+	case AuthorizeFormatJSON:
+		req.Header.Set("Content-Type", "application/json")
+	case AuthorizeFormatHeaders:
+		req.Header.Set("X-MQTT-Client-ID", request.ClientID)
+		req.Header.Set("X-MQTT-Remote-Addr", request.RemoteAddr)
+		req.Header.Set("X-MQTT-Listener", request.Listener)
+		req.Header.Set("X-MQTT-Protocol-Version", strconv.Itoa(int(request.ProtocolVersion)))
+		req.Header.Set("X-MQTT-Clean-Start", strconv.FormatBool(request.CleanStart))
+		if request.CertFingerprint != "" {
+			req.Header.Set("X-MQTT-Cert-Subject", request.CertSubject)
+			req.Header.Set("X-MQTT-Cert-Fingerprint", request.CertFingerprint)
+		}
+	}
 
 	res, err := client.Do(req)
 	if err != nil {
-		return false, err
+		return nil, "", err
 	}
+	defer res.Body.Close()
 
 	labels := prometheus.Labels{
-		"url":  c.AuthorizeURL,
+		"url":  authorizeURL,
 		"code": strconv.Itoa(res.StatusCode),
 	}
 	c.Metrics.authenticateCounter.With(labels).Inc()
 
+	cacheControl := res.Header.Get("Cache-Control")
+
+	response := &AuthResponse{}
+	mediaType, _, _ := mime.ParseMediaType(res.Header.Get("Content-Type"))
+
 	success := res.StatusCode == 200 || res.StatusCode == 201
 	if !success {
-		return false, fmt.Errorf("auth post failed with status code %d", res.StatusCode)
+		authErr := &AuthError{StatusCode: res.StatusCode}
+		if mediaType == "application/json" && json.NewDecoder(res.Body).Decode(response) == nil {
+			authErr.Reason = response.Reason
+		}
+		return nil, cacheControl, authErr
 	}
 
-	return true, nil
+	if mediaType == "application/json" {
+		err = json.NewDecoder(res.Body).Decode(response)
+		if err != nil && err != io.EOF {
+			return nil, "", fmt.Errorf("invalid auth response: %w", err)
+		}
+	}
+
+	return response, cacheControl, nil
 }
 
-func (c *HTTPClient) Publish(url string, topic string, payload []byte) error {
-	publishURL := strings.Replace(url, "{topic}", topic, 1)
+func (c *HTTPClient) Publish(route Route, topic string, payload []byte, sender *Client) error {
+	publishURL := strings.Replace(route.URL, "{topic}", topic, 1)
 	reader := bytes.NewReader(payload)
 
 	client := &http.Client{Timeout: clientTimeout}
@@ -75,6 +204,9 @@ func (c *HTTPClient) Publish(url string, topic string, payload []byte) error {
 	if c.TopicHeader != "" {
 		req.Header.Set(c.TopicHeader, topic)
 	}
+	for name, value := range route.Headers {
+		req.Header.Set(name, ExpandHeader(value, topic, sender))
+	}
 
 	res, err := client.Do(req)
 	if err != nil {
@@ -0,0 +1,267 @@
+package lib
+
+import (
+	"crypto"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// jwksMinRefresh limits how often an unknown key ID triggers a download of
+// the key set, whether the last one succeeded or not.
+const jwksMinRefresh = 30 * time.Second
+
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// JWKS holds the public keys used to verify JWTs, read from a JSON Web Key
+// Set file or URL. The keys are looked up by key ID.
+type JWKS struct {
+	File        string
+	URL         string
+	keys        map[string]crypto.PublicKey
+	files       *fileWatcher
+	refreshedAt time.Time
+	mutex       sync.RWMutex
+	refreshing  sync.Mutex
+}
+
+func NewJWKS(file string, url string) (*JWKS, error) {
+	jwks := &JWKS{File: file, URL: url, files: newFileWatcher(file)}
+	err := jwks.Reload()
+	if err != nil {
+		return nil, err
+	}
+	return jwks, nil
+}
+
+// Reload reads the key set again. The previous keys are kept when the new
+// set cannot be read.
+func (k *JWKS) Reload() error {
+	var data []byte
+	var err error
+	modTimes := k.files.stat()
+	if k.File != "" {
+		data, err = os.ReadFile(k.File)
+		if err != nil {
+			return fmt.Errorf("failed to read JWKS file: %w", err)
+		}
+	} else {
+		data, err = fetchJWKS(k.URL)
+		if err != nil {
+			return err
+		}
+	}
+
+	keys, err := ParseJWKS(data)
+	if err != nil {
+		return err
+	}
+
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+
+	k.keys = keys
+	k.files.loaded(modTimes)
+	k.refreshedAt = time.Now()
+	return nil
+}
+
+// Watch reloads the key set every interval when it comes from a URL, or
+// when the file was modified, until stop is closed.
+func (k *JWKS) Watch(interval time.Duration, stop <-chan struct{}) {
+	if k.File != "" {
+		watchFiles(interval, stop, k.files.changed, k.Reload, "JWKS", "file", k.File)
+		return
+	}
+	watchFiles(interval, stop, nil, k.Reload, "JWKS", "url", k.URL)
+}
+
+// Key returns the key with the given ID. An empty ID matches the only key
+// of a set with a single key. When the ID is unknown and the keys come from
+// a URL, the set is downloaded again in case the keys were rotated.
+func (k *JWKS) Key(kid string) (crypto.PublicKey, bool) {
+	key, ok, stale := k.lookup(kid)
+	if ok || !stale {
+		return key, ok
+	}
+
+	k.refresh()
+	key, ok, _ = k.lookup(kid)
+	return key, ok
+}
+
+// refresh downloads the key set again. Concurrent callers wait for a single
+// download, and the attempt is recorded even when it fails, so an unknown
+// key ID cannot trigger more than one download every jwksMinRefresh.
+func (k *JWKS) refresh() {
+	k.refreshing.Lock()
+	defer k.refreshing.Unlock()
+
+	k.mutex.Lock()
+	if time.Since(k.refreshedAt) <= jwksMinRefresh {
+		k.mutex.Unlock()
+		return
+	}
+	k.refreshedAt = time.Now()
+	k.mutex.Unlock()
+
+	err := k.Reload()
+	if err != nil {
+		slog.Error("Failed to refresh JWKS", "err", err)
+	}
+}
+
+func (k *JWKS) lookup(kid string) (crypto.PublicKey, bool, bool) {
+	k.mutex.RLock()
+	defer k.mutex.RUnlock()
+
+	stale := k.URL != "" && time.Since(k.refreshedAt) > jwksMinRefresh
+	if key, ok := k.keys[kid]; ok {
+		return key, true, stale
+	}
+	if kid == "" && len(k.keys) == 1 {
+		for _, key := range k.keys {
+			return key, true, stale
+		}
+	}
+	return nil, false, stale
+}
+
+func fetchJWKS(url string) ([]byte, error) {
+	client := &http.Client{Timeout: clientTimeout}
+	res, err := client.Get(url)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch JWKS: %w", err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to fetch JWKS: status code %d", res.StatusCode)
+	}
+	return io.ReadAll(res.Body)
+}
+
+// ParseJWKS reads the RSA, EC and Ed25519 signing keys of a JSON Web Key
+// Set. Other keys are ignored.
+func ParseJWKS(data []byte) (map[string]crypto.PublicKey, error) {
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	err := json.Unmarshal(data, &set)
+	if err != nil {
+		return nil, fmt.Errorf("invalid JWKS: %w", err)
+	}
+
+	keys := make(map[string]crypto.PublicKey)
+	for _, jwk := range set.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		key, err := jwk.publicKey()
+		if err != nil {
+			return nil, fmt.Errorf("invalid key %q: %w", jwk.Kid, err)
+		}
+		if key != nil {
+			keys[jwk.Kid] = key
+		}
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("no signing key found in JWKS")
+	}
+	return keys, nil
+}
+
+func (j *jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	switch j.Kty {
+	case "RSA":
+		n, err := decodeBigInt(j.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(j.E)
+		if err != nil {
+			return nil, err
+		}
+		if !e.IsInt64() || e.Int64() < 3 || e.Int64() > 1<<31-1 {
+			return nil, errors.New("invalid RSA exponent")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		var ecdhCurve ecdh.Curve
+		switch j.Crv {
+		case "P-256":
+			curve, ecdhCurve = elliptic.P256(), ecdh.P256()
+		case "P-384":
+			curve, ecdhCurve = elliptic.P384(), ecdh.P384()
+		case "P-521":
+			curve, ecdhCurve = elliptic.P521(), ecdh.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", j.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(j.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := base64.RawURLEncoding.DecodeString(j.Y)
+		if err != nil {
+			return nil, err
+		}
+		size := (curve.Params().BitSize + 7) / 8
+		if len(x) != size || len(y) != size {
+			return nil, errors.New("invalid EC coordinates")
+		}
+		// Let crypto/ecdh validate that the point is on the curve.
+		point := append(append([]byte{4}, x...), y...)
+		if _, err := ecdhCurve.NewPublicKey(point); err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}, nil
+	case "OKP":
+		if j.Crv != "Ed25519" {
+			return nil, fmt.Errorf("unsupported curve %q", j.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(j.X)
+		if err != nil {
+			return nil, err
+		}
+		if len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("invalid Ed25519 key")
+		}
+		return ed25519.PublicKey(x), nil
+	}
+	return nil, nil
+}
+
+func decodeBigInt(value string) (*big.Int, error) {
+	data, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) == 0 {
+		return nil, errors.New("missing key parameter")
+	}
+	return new(big.Int).SetBytes(data), nil
+}
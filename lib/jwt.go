@@ -0,0 +1,250 @@
+package lib
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"slices"
+	"strings"
+	"time"
+)
+
+// jwtLeeway tolerates clock skew when checking exp and nbf.
+const jwtLeeway = 30 * time.Second
+
+// JWTVerifier authenticates clients sending a JWT as their password, without
+// calling the authorize endpoint.
+type JWTVerifier struct {
+	Keys             *JWKS
+	Issuer           string
+	Audience         string
+	UsernameClaim    string
+	PermissionsClaim string
+}
+
+// JWTIdentity is what a verified token says about the client.
+type JWTIdentity struct {
+	Username    string
+	Permissions *Permissions
+}
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+// LooksLikeJWT reports whether the password has the shape of a JWS compact
+// serialization with a JSON header.
+func LooksLikeJWT(password string) bool {
+	return strings.Count(password, ".") == 2 && strings.HasPrefix(password, "eyJ")
+}
+
+// Authenticate abstains when the password is not a JWT, and otherwise
+// allows or denies the client depending on the token.
+func (v *JWTVerifier) Authenticate(request AuthRequest) (AuthResult, *Identity, error) {
+	if !LooksLikeJWT(request.Password) {
+		return AuthAbstain, nil, nil
+	}
+
+	identity, err := v.Verify(request.Password)
+	if err != nil {
+		slog.Info("Invalid JWT", "err", err, "client", request.ClientID)
+		return AuthDeny, nil, nil
+	}
+	return AuthAllow, &Identity{Username: identity.Username, Permissions: identity.Permissions}, nil
+}
+
+// Verify checks the signature, validity period, issuer and audience of the
+// token and returns the identity it carries.
+func (v *JWTVerifier) Verify(token string) (*JWTIdentity, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed token")
+	}
+
+	var header jwtHeader
+	err := decodeSegment(parts[0], &header)
+	if err != nil {
+		return nil, fmt.Errorf("invalid header: %w", err)
+	}
+
+	key, ok := v.Keys.Key(header.Kid)
+	if !ok {
+		return nil, fmt.Errorf("unknown key %q", header.Kid)
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("invalid signature: %w", err)
+	}
+	err = verifySignature(header.Alg, key, []byte(parts[0]+"."+parts[1]), signature)
+	if err != nil {
+		return nil, err
+	}
+
+	var claims map[string]json.RawMessage
+	err = decodeSegment(parts[1], &claims)
+	if err != nil {
+		return nil, fmt.Errorf("invalid claims: %w", err)
+	}
+
+	err = v.checkClaims(claims, time.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	identity := &JWTIdentity{}
+	err = json.Unmarshal(claims[v.UsernameClaim], &identity.Username)
+	if err != nil || identity.Username == "" {
+		return nil, fmt.Errorf("missing %q claim", v.UsernameClaim)
+	}
+
+	if raw, ok := claims[v.PermissionsClaim]; ok && v.PermissionsClaim != "" {
+		permissions := &Permissions{}
+		err = json.Unmarshal(raw, permissions)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %q claim: %w", v.PermissionsClaim, err)
+		}
+		if !permissions.IsEmpty() {
+			identity.Permissions = permissions
+		}
+	}
+
+	return identity, nil
+}
+
+func (v *JWTVerifier) checkClaims(claims map[string]json.RawMessage, now time.Time) error {
+	exp, err := numericDate(claims, "exp")
+	if err != nil {
+		return err
+	}
+	if exp == nil {
+		return errors.New("missing \"exp\" claim")
+	}
+	if now.After(exp.Add(jwtLeeway)) {
+		return errors.New("token expired")
+	}
+
+	nbf, err := numericDate(claims, "nbf")
+	if err != nil {
+		return err
+	}
+	if nbf != nil && now.Add(jwtLeeway).Before(*nbf) {
+		return errors.New("token not valid yet")
+	}
+
+	if v.Issuer != "" {
+		var issuer string
+		json.Unmarshal(claims["iss"], &issuer)
+		if issuer != v.Issuer {
+			return fmt.Errorf("unexpected issuer %q", issuer)
+		}
+	}
+
+	if v.Audience != "" {
+		// The audience is either a single string or an array of strings.
+		var audiences []string
+		if json.Unmarshal(claims["aud"], &audiences) != nil {
+			var audience string
+			json.Unmarshal(claims["aud"], &audience)
+			audiences = []string{audience}
+		}
+		if !slices.Contains(audiences, v.Audience) {
+			return errors.New("token not issued for this audience")
+		}
+	}
+
+	return nil
+}
+
+func numericDate(claims map[string]json.RawMessage, name string) (*time.Time, error) {
+	raw, ok := claims[name]
+	if !ok {
+		return nil, nil
+	}
+	var seconds float64
+	err := json.Unmarshal(raw, &seconds)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %q claim: %w", name, err)
+	}
+	date := time.Unix(int64(seconds), 0)
+	return &date, nil
+}
+
+func decodeSegment(segment string, v any) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// jwtAlgorithms maps the supported signature algorithms to their hash.
+var jwtAlgorithms = map[string]crypto.Hash{
+	"RS256": crypto.SHA256,
+	"RS384": crypto.SHA384,
+	"RS512": crypto.SHA512,
+	"PS256": crypto.SHA256,
+	"PS384": crypto.SHA384,
+	"PS512": crypto.SHA512,
+	"ES256": crypto.SHA256,
+	"ES384": crypto.SHA384,
+	"ES512": crypto.SHA512,
+	"EdDSA": crypto.Hash(0),
+}
+
+// ecdsaCurveSizes maps the ECDSA algorithms to the bit size of their curve.
+var ecdsaCurveSizes = map[string]int{
+	"ES256": 256,
+	"ES384": 384,
+	"ES512": 521,
+}
+
+func verifySignature(alg string, key crypto.PublicKey, signed []byte, signature []byte) error {
+	hash, ok := jwtAlgorithms[alg]
+	if !ok {
+		return fmt.Errorf("unsupported algorithm %q", alg)
+	}
+
+	var digest []byte
+	if hash != 0 {
+		h := hash.New()
+		h.Write(signed)
+		digest = h.Sum(nil)
+	}
+
+	valid := false
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		if strings.HasPrefix(alg, "RS") {
+			valid = rsa.VerifyPKCS1v15(key, hash, digest, signature) == nil
+		} else if strings.HasPrefix(alg, "PS") {
+			valid = rsa.VerifyPSS(key, hash, digest, signature, nil) == nil
+		}
+	case *ecdsa.PublicKey:
+		size := (key.Curve.Params().BitSize + 7) / 8
+		if ecdsaCurveSizes[alg] == key.Curve.Params().BitSize && len(signature) == 2*size {
+			r := new(big.Int).SetBytes(signature[:size])
+			s := new(big.Int).SetBytes(signature[size:])
+			valid = ecdsa.Verify(key, digest, r, s)
+		}
+	case ed25519.PublicKey:
+		if alg == "EdDSA" {
+			valid = ed25519.Verify(key, signed, signature)
+		}
+	}
+
+	if !valid {
+		return errors.New("invalid signature")
+	}
+	return nil
+}
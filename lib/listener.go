@@ -0,0 +1,135 @@
+package lib
+
+import (
+	"crypto/tls"
+	"log/slog"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+
+	"github.com/mochi-mqtt/server/v2/listeners"
+)
+
+// StreamListener accepts MQTT connections on a TCP address or Unix socket,
+// optionally behind a PROXY protocol speaking load balancer and over TLS.
+type StreamListener struct {
+	id        string
+	network   string
+	address   string
+	tlsConfig *tls.Config
+	trusted   []*net.IPNet
+	proxy     bool
+	listen    net.Listener
+	log       *slog.Logger
+	end       uint32
+	mutex     sync.Mutex
+}
+
+// NewStreamListener creates a listener on network ("tcp" or "unix").
+func NewStreamListener(id string, network string, address string, tlsConfig *tls.Config) *StreamListener {
+	return &StreamListener{
+		id:        id,
+		network:   network,
+		address:   address,
+		tlsConfig: tlsConfig,
+	}
+}
+
+// SetProxyProtocol enables PROXY headers from the trusted peers.
+func (l *StreamListener) SetProxyProtocol(trusted []*net.IPNet) {
+	l.proxy = true
+	l.trusted = trusted
+}
+
+func (l *StreamListener) ID() string {
+	return l.id
+}
+
+func (l *StreamListener) Address() string {
+	if l.listen != nil {
+		return l.listen.Addr().String()
+	}
+	return l.address
+}
+
+func (l *StreamListener) Protocol() string {
+	if l.tlsConfig != nil {
+		return "tls"
+	}
+	return l.network
+}
+
+func (l *StreamListener) Init(log *slog.Logger) error {
+	l.log = log
+
+	if l.network == "unix" {
+		removeSocket(l.address)
+	}
+
+	listen, err := net.Listen(l.network, l.address)
+	if err != nil {
+		return err
+	}
+	l.listen = wrapListener(listen, l.tlsConfig, l.proxy, l.trusted)
+
+	return nil
+}
+
+func (l *StreamListener) Serve(establish listeners.EstablishFn) {
+	for {
+		if atomic.LoadUint32(&l.end) == 1 {
+			return
+		}
+
+		conn, err := l.listen.Accept()
+		if err != nil {
+			return
+		}
+
+		if atomic.LoadUint32(&l.end) == 0 {
+			go func() {
+				err := establish(l.id, conn)
+				if err != nil {
+					l.log.Warn("Client stopped", "err", err, "listener", l.id)
+				}
+			}()
+		}
+	}
+}
+
+func (l *StreamListener) Close(closeClients listeners.CloseFn) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if atomic.CompareAndSwapUint32(&l.end, 0, 1) {
+		closeClients(l.id)
+	}
+
+	if l.listen != nil {
+		_ = l.listen.Close()
+		if l.network == "unix" {
+			removeSocket(l.address)
+		}
+	}
+}
+
+// removeSocket removes the socket file left at path by a previous run, but
+// never a file of another kind.
+func removeSocket(path string) {
+	if info, err := os.Lstat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		_ = os.Remove(path)
+	}
+}
+
+// wrapListener adds PROXY protocol parsing, then TLS, around listen. The
+// PROXY header is sent in clear text before the TLS handshake.
+func wrapListener(listen net.Listener, tlsConfig *tls.Config, proxy bool, trusted []*net.IPNet) net.Listener {
+	if proxy {
+		listen = NewProxyListener(listen, trusted)
+	}
+	if tlsConfig != nil {
+		listen = tls.NewListener(listen, tlsConfig)
+	}
+	return listen
+}
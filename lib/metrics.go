@@ -6,22 +6,28 @@ import (
 )
 
 type Metrics struct {
-	sessionGauge        prometheus.Gauge
+	sessionGauge        *prometheus.GaugeVec
 	authenticateCounter *prometheus.CounterVec
 	publishCounter      *prometheus.CounterVec
 	forwardCounter      *prometheus.CounterVec
 	subscribeCounter    *prometheus.CounterVec
 	noMatchCounter      *prometheus.CounterVec
+	aclCounter          *prometheus.CounterVec
+	authCacheCounter    *prometheus.CounterVec
+	connectLimitCounter *prometheus.CounterVec
+	lockoutCounter      *prometheus.CounterVec
+	sessionLimitCounter *prometheus.CounterVec
 }
 
 func NewMetrics(reg prometheus.Registerer) *Metrics {
 	metrics := &Metrics{}
 
-	metrics.sessionGauge = promauto.With(reg).NewGauge(
+	metrics.sessionGauge = promauto.With(reg).NewGaugeVec(
 		prometheus.GaugeOpts{
 			Namespace: "mqtt2http",
 			Name:      "sessions",
 		},
+		[]string{"listener"},
 	)
 
 	metrics.authenticateCounter = promauto.With(reg).NewCounterVec(
@@ -37,7 +43,7 @@ func NewMetrics(reg prometheus.Registerer) *Metrics {
 			Namespace: "mqtt2http",
 			Name:      "publish_count",
 		},
-		[]string{"topic"},
+		[]string{"topic", "listener"},
 	)
 
 	metrics.forwardCounter = promauto.With(reg).NewCounterVec(
@@ -64,5 +70,45 @@ func NewMetrics(reg prometheus.Registerer) *Metrics {
 		[]string{"topic"},
 	)
 
+	metrics.aclCounter = promauto.With(reg).NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "mqtt2http",
+			Name:      "acl_check_count",
+		},
+		[]string{"result", "cached"},
+	)
+
+	metrics.authCacheCounter = promauto.With(reg).NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "mqtt2http",
+			Name:      "auth_cache_count",
+		},
+		[]string{"result"},
+	)
+
+	metrics.connectLimitCounter = promauto.With(reg).NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "mqtt2http",
+			Name:      "connect_limit_count",
+		},
+		[]string{"kind", "reason"},
+	)
+
+	metrics.lockoutCounter = promauto.With(reg).NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "mqtt2http",
+			Name:      "lockout_count",
+		},
+		[]string{"kind"},
+	)
+
+	metrics.sessionLimitCounter = promauto.With(reg).NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "mqtt2http",
+			Name:      "session_limit_count",
+		},
+		[]string{"reason", "action"},
+	)
+
 	return metrics
 }
@@ -0,0 +1,65 @@
+package lib
+
+// Permissions restrict what a session may do. They are returned by the
+// authorize endpoint at connect time. A nil list or attribute means the
+// authorize endpoint did not restrict it.
+type Permissions struct {
+	Publish   []string `json:"publish"`
+	Subscribe []string `json:"subscribe"`
+	MaxQoS    *byte    `json:"max_qos"`
+	Retain    *bool    `json:"retain"`
+}
+
+// IsEmpty reports whether the permissions restrict nothing.
+func (p *Permissions) IsEmpty() bool {
+	return p.Publish == nil && p.Subscribe == nil && p.MaxQoS == nil && p.Retain == nil
+}
+
+// CanPublish reports whether the client may publish to the topic.
+func (p *Permissions) CanPublish(client *Client, topic string) bool {
+	if p.Publish == nil {
+		return true
+	}
+	for _, filter := range p.Publish {
+		filter, ok := ExpandPlaceholders(filter, client)
+		if ok && MatchTopic(filter, topic) {
+			return true
+		}
+	}
+	return false
+}
+
+// CanSubscribe reports whether the client may subscribe to the filter. A
+// shared subscription is allowed in any group by a filter covering its
+// topics, or in its group by a shared filter.
+func (p *Permissions) CanSubscribe(client *Client, filter string) bool {
+	if p.Subscribe == nil {
+		return true
+	}
+	topics := sharedFilterTopics(filter)
+	for _, allowed := range p.Subscribe {
+		allowed, ok := ExpandPlaceholders(allowed, client)
+		if ok && (CoversFilter(allowed, filter) || CoversFilter(allowed, topics)) {
+			return true
+		}
+	}
+	return false
+}
+
+// AllowsQoS reports whether messages may use the QoS level.
+func (p *Permissions) AllowsQoS(qos byte) bool {
+	return p.MaxQoS == nil || qos <= *p.MaxQoS
+}
+
+// LimitQoS lowers qos to the maximum allowed level.
+func (p *Permissions) LimitQoS(qos byte) byte {
+	if p.MaxQoS != nil && qos > *p.MaxQoS {
+		return *p.MaxQoS
+	}
+	return qos
+}
+
+// AllowsRetain reports whether retained messages may be published.
+func (p *Permissions) AllowsRetain() bool {
+	return p.Retain == nil || *p.Retain
+}
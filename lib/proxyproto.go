@@ -0,0 +1,214 @@
+package lib
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// proxyHeaderTimeout bounds the time a trusted peer has to send its header.
+const proxyHeaderTimeout = 5 * time.Second
+
+// proxyV1MaxLength is the longest v1 header, CRLF included.
+const proxyV1MaxLength = 107
+
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// ProxyListener reads PROXY protocol v1 and v2 headers sent by trusted
+// peers, so connections report the address of the original client.
+// Connections from other peers are passed through untouched.
+type ProxyListener struct {
+	net.Listener
+	trusted []*net.IPNet
+}
+
+func NewProxyListener(listener net.Listener, trusted []*net.IPNet) *ProxyListener {
+	return &ProxyListener{Listener: listener, trusted: trusted}
+}
+
+// ParseCIDRs parses a list of CIDRs or single IP addresses.
+func ParseCIDRs(values []string) ([]*net.IPNet, error) {
+	networks := []*net.IPNet{}
+	for _, value := range values {
+		if !strings.Contains(value, "/") {
+			ip := net.ParseIP(value)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP address %q", value)
+			}
+			bits := 8 * len(ip.To16())
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(value)
+		if err != nil {
+			return nil, err
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+func (l *ProxyListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if !l.isTrusted(conn.RemoteAddr()) {
+		return conn, nil
+	}
+	return &proxyConn{Conn: conn, reader: bufio.NewReader(conn)}, nil
+}
+
+func (l *ProxyListener) isTrusted(addr net.Addr) bool {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		// Unix socket peers are local and always trusted.
+		return true
+	}
+	for _, network := range l.trusted {
+		if network.Contains(tcpAddr.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// proxyConn parses the PROXY header lazily, on the first call to Read or
+// RemoteAddr, so a slow peer does not block the accept loop.
+type proxyConn struct {
+	net.Conn
+	reader *bufio.Reader
+	remote net.Addr
+	err    error
+	once   sync.Once
+}
+
+func (c *proxyConn) Read(p []byte) (int, error) {
+	c.once.Do(c.readHeader)
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.reader.Read(p)
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	c.once.Do(c.readHeader)
+	if c.remote != nil {
+		return c.remote
+	}
+	return c.Conn.RemoteAddr()
+}
+
+func (c *proxyConn) readHeader() {
+	c.Conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+	defer c.Conn.SetReadDeadline(time.Time{})
+
+	c.remote, c.err = readProxyHeader(c.reader)
+	if c.err != nil {
+		c.err = fmt.Errorf("invalid PROXY protocol header: %w", c.err)
+		c.Conn.Close()
+	}
+}
+
+// readProxyHeader consumes a v1 or v2 header and returns the source address
+// it carries, or nil for LOCAL and UNKNOWN connections.
+func readProxyHeader(reader *bufio.Reader) (net.Addr, error) {
+	signature, err := reader.Peek(len(proxyV2Signature))
+	if err != nil {
+		return nil, err
+	}
+	if bytes.Equal(signature, proxyV2Signature) {
+		return readProxyHeaderV2(reader)
+	}
+	if bytes.HasPrefix(signature, []byte("PROXY ")) {
+		return readProxyHeaderV1(reader)
+	}
+	return nil, errors.New("missing header")
+}
+
+// readProxyHeaderV1 reads the header line byte by byte, so that a peer
+// never sending a line feed is rejected after proxyV1MaxLength bytes.
+func readProxyHeaderV1(reader *bufio.Reader) (net.Addr, error) {
+	line := make([]byte, 0, proxyV1MaxLength)
+	for len(line) < proxyV1MaxLength && !bytes.HasSuffix(line, []byte("\n")) {
+		b, err := reader.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, errors.New("malformed v1 header")
+	}
+
+	fields := strings.Fields(string(line[:len(line)-2]))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, errors.New("malformed v1 header")
+	}
+
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.Atoi(fields[4])
+	if ip == nil || err != nil || port < 0 || port > 65535 {
+		return nil, errors.New("invalid v1 source address")
+	}
+	return &net.TCPAddr{IP: ip, Port: port}, nil
+}
+
+func readProxyHeaderV2(reader *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, 16)
+	_, err := io.ReadFull(reader, header)
+	if err != nil {
+		return nil, err
+	}
+
+	version, command := header[12]>>4, header[12]&0x0f
+	if version != 2 {
+		return nil, fmt.Errorf("unsupported version %d", version)
+	}
+	family, transport := header[13]>>4, header[13]&0x0f
+
+	payload := make([]byte, binary.BigEndian.Uint16(header[14:16]))
+	_, err = io.ReadFull(reader, payload)
+	if err != nil {
+		return nil, err
+	}
+
+	// LOCAL connections are health checks from the proxy itself.
+	if command == 0x0 {
+		return nil, nil
+	}
+	if command != 0x1 {
+		return nil, fmt.Errorf("unsupported command %d", command)
+	}
+	if transport != 0x1 {
+		return nil, fmt.Errorf("unsupported transport %d", transport)
+	}
+
+	switch family {
+	case 0x1: // AF_INET
+		if len(payload) < 12 {
+			return nil, errors.New("short IPv4 address block")
+		}
+		return &net.TCPAddr{IP: net.IP(payload[0:4]), Port: int(binary.BigEndian.Uint16(payload[8:10]))}, nil
+	case 0x2: // AF_INET6
+		if len(payload) < 36 {
+			return nil, errors.New("short IPv6 address block")
+		}
+		return &net.TCPAddr{IP: net.IP(payload[0:16]), Port: int(binary.BigEndian.Uint16(payload[32:34]))}, nil
+	}
+	return nil, fmt.Errorf("unsupported address family %d", family)
+}
@@ -0,0 +1,260 @@
+package lib
+
+import (
+	"errors"
+	"log/slog"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// What connect limits and lockouts apply to.
+const (
+	LimitIP       = "ip"
+	LimitUsername = "username"
+)
+
+// connectLimiterMaxEntries triggers a sweep of idle buckets and forgotten
+// failures when reached.
+const connectLimiterMaxEntries = 10000
+
+var (
+	ErrConnectRateExceeded = errors.New("connect rate exceeded")
+	ErrLockedOut           = errors.New("locked out after repeated authentication failures")
+)
+
+type limitKey struct {
+	kind  string
+	value string
+}
+
+type tokenBucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+type failureRecord struct {
+	failures    int
+	lockouts    int
+	lockedUntil time.Time
+	updated     time.Time
+}
+
+// Lockout is a remote IP or username refused after too many failures.
+type Lockout struct {
+	Kind        string    `json:"kind"`
+	Key         string    `json:"key"`
+	Lockouts    int       `json:"lockouts"`
+	LockedUntil time.Time `json:"locked_until"`
+}
+
+// ConnectLimiter limits connect attempts with token buckets per remote IP
+// and per username, refilled at the given rate per second, and locks both
+// out for Lockout after MaxFailures failed authentications in a row. Every
+// further lockout of the same key lasts twice as long, up to MaxLockout.
+// A successful authentication forgets the failures.
+type ConnectLimiter struct {
+	IPRate        float64
+	IPBurst       int
+	UsernameRate  float64
+	UsernameBurst int
+	MaxFailures   int
+	Lockout       time.Duration
+	MaxLockout    time.Duration
+	Metrics       *Metrics
+	buckets       map[limitKey]*tokenBucket
+	failures      map[limitKey]*failureRecord
+	mutex         sync.Mutex
+}
+
+func NewConnectLimiter(metrics *Metrics) *ConnectLimiter {
+	return &ConnectLimiter{
+		Metrics:  metrics,
+		buckets:  make(map[limitKey]*tokenBucket),
+		failures: make(map[limitKey]*failureRecord),
+	}
+}
+
+// Allow takes a token for the remote IP and the username, and returns an
+// error when either is locked out or out of tokens.
+func (l *ConnectLimiter) Allow(remoteAddr string, username string) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	now := time.Now()
+	keys := limitKeys(remoteAddr, username)
+
+	for _, key := range keys {
+		if record, ok := l.failures[key]; ok && now.Before(record.lockedUntil) {
+			l.count(key.kind, "lockout")
+			return ErrLockedOut
+		}
+	}
+
+	l.sweep(now)
+	buckets := []*tokenBucket{}
+	for _, key := range keys {
+		rate, burst := l.limit(key.kind)
+		if rate <= 0 {
+			continue
+		}
+
+		bucket, ok := l.buckets[key]
+		if !ok {
+			bucket = &tokenBucket{tokens: float64(burst), updated: now}
+			l.buckets[key] = bucket
+		}
+		bucket.tokens = min(float64(burst), bucket.tokens+now.Sub(bucket.updated).Seconds()*rate)
+		bucket.updated = now
+		if bucket.tokens < 1 {
+			l.count(key.kind, "rate")
+			return ErrConnectRateExceeded
+		}
+		buckets = append(buckets, bucket)
+	}
+
+	for _, bucket := range buckets {
+		bucket.tokens--
+	}
+	return nil
+}
+
+// Failure records a failed authentication, locking the remote IP and the
+// username out when they reach MaxFailures.
+func (l *ConnectLimiter) Failure(remoteAddr string, username string) {
+	if l.MaxFailures <= 0 {
+		return
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	now := time.Now()
+	for _, key := range limitKeys(remoteAddr, username) {
+		record, ok := l.failures[key]
+		if !ok {
+			record = &failureRecord{}
+			l.failures[key] = record
+		}
+		record.failures++
+		record.updated = now
+		if record.failures < l.MaxFailures {
+			continue
+		}
+
+		duration := l.Lockout
+		for i := 0; i < record.lockouts && duration < l.MaxLockout; i++ {
+			duration *= 2
+		}
+		duration = min(duration, max(l.Lockout, l.MaxLockout))
+		record.failures = 0
+		record.lockouts++
+		record.lockedUntil = now.Add(duration)
+
+		slog.Warn("Locked out after authentication failures", "kind", key.kind, "key", key.value, "duration", duration)
+		l.Metrics.lockoutCounter.With(prometheus.Labels{"kind": key.kind}).Inc()
+	}
+}
+
+// Success forgets the failures of the remote IP and the username.
+func (l *ConnectLimiter) Success(remoteAddr string, username string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	for _, key := range limitKeys(remoteAddr, username) {
+		delete(l.failures, key)
+	}
+}
+
+// Lockouts returns the current lockouts sorted by kind and key.
+func (l *ConnectLimiter) Lockouts() []Lockout {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	now := time.Now()
+	lockouts := []Lockout{}
+	for key, record := range l.failures {
+		if now.Before(record.lockedUntil) {
+			lockouts = append(lockouts, Lockout{Kind: key.kind, Key: key.value, Lockouts: record.lockouts, LockedUntil: record.lockedUntil})
+		}
+	}
+	slices.SortFunc(lockouts, func(a, b Lockout) int {
+		if a.Kind != b.Kind {
+			return strings.Compare(a.Kind, b.Kind)
+		}
+		return strings.Compare(a.Key, b.Key)
+	})
+	return lockouts
+}
+
+// Clear lifts the lockouts matching kind and key, where empty values match
+// everything, and returns how many were lifted. Their failures are
+// forgotten as well.
+func (l *ConnectLimiter) Clear(kind string, key string) int {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	now := time.Now()
+	cleared := 0
+	for k, record := range l.failures {
+		if kind != "" && k.kind != kind || key != "" && k.value != key {
+			continue
+		}
+		if now.Before(record.lockedUntil) {
+			cleared++
+		}
+		delete(l.failures, k)
+	}
+	return cleared
+}
+
+func (l *ConnectLimiter) limit(kind string) (float64, int) {
+	if kind == LimitIP {
+		return l.IPRate, max(l.IPBurst, 1)
+	}
+	return l.UsernameRate, max(l.UsernameBurst, 1)
+}
+
+func (l *ConnectLimiter) count(kind string, reason string) {
+	l.Metrics.connectLimitCounter.With(prometheus.Labels{"kind": kind, "reason": reason}).Inc()
+}
+
+// sweep drops full buckets and failures that were neither locked nor
+// updated for MaxLockout once the maps grow large.
+func (l *ConnectLimiter) sweep(now time.Time) {
+	if len(l.buckets) >= connectLimiterMaxEntries {
+		for key, bucket := range l.buckets {
+			rate, burst := l.limit(key.kind)
+			if bucket.tokens+now.Sub(bucket.updated).Seconds()*rate >= float64(burst) {
+				delete(l.buckets, key)
+			}
+		}
+	}
+
+	if len(l.failures) >= connectLimiterMaxEntries {
+		forget := max(l.MaxLockout, l.Lockout)
+		for key, record := range l.failures {
+			if now.After(record.lockedUntil) && now.Sub(record.updated) > forget {
+				delete(l.failures, key)
+			}
+		}
+	}
+}
+
+// limitKeys returns the keys of the remote IP and, when set, the username.
+func limitKeys(remoteAddr string, username string) []limitKey {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+
+	keys := []limitKey{{kind: LimitIP, value: host}}
+	if username != "" {
+		keys = append(keys, limitKey{kind: LimitUsername, value: username})
+	}
+	return keys
+}
@@ -0,0 +1,79 @@
+package lib
+
+import (
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+)
+
+// RetainedMessage is a message retained by the broker. The payload is
+// encoded in base64.
+type RetainedMessage struct {
+	Topic          string         `json:"topic"`
+	Payload        []byte         `json:"payload"`
+	QoS            byte           `json:"qos"`
+	ContentType    string         `json:"content_type,omitempty"`
+	MessageExpiry  uint32         `json:"message_expiry,omitempty"`
+	UserProperties []UserProperty `json:"user_properties,omitempty"`
+	CreatedAt      time.Time      `json:"created_at"`
+}
+
+type UserProperty struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+func NewRetainedMessage(pk packets.Packet) RetainedMessage {
+	message := RetainedMessage{
+		Topic:         pk.TopicName,
+		Payload:       pk.Payload,
+		QoS:           pk.FixedHeader.Qos,
+		ContentType:   pk.Properties.ContentType,
+		MessageExpiry: pk.Properties.MessageExpiryInterval,
+		CreatedAt:     time.Unix(pk.Created, 0).UTC(),
+	}
+	for _, property := range pk.Properties.User {
+		message.UserProperties = append(message.UserProperties, UserProperty{Key: property.Key, Value: property.Val})
+	}
+	return message
+}
+
+// NewRetainedMessages converts retained packets, sorted by topic.
+func NewRetainedMessages(pks []packets.Packet) []RetainedMessage {
+	messages := make([]RetainedMessage, 0, len(pks))
+	for _, pk := range pks {
+		messages = append(messages, NewRetainedMessage(pk))
+	}
+	slices.SortFunc(messages, func(a, b RetainedMessage) int {
+		return strings.Compare(a.Topic, b.Topic)
+	})
+	return messages
+}
+
+// DeleteRetained removes the message retained on a topic without delivering
+// anything to the subscribers, and reports whether there was one.
+func DeleteRetained(server *mqtt.Server, topic string) bool {
+	deleted := server.Topics.RetainMessage(packets.Packet{
+		FixedHeader: packets.FixedHeader{Type: packets.Publish, Retain: true},
+		TopicName:   topic,
+	}) < 0
+	atomic.StoreInt64(&server.Info.Retained, int64(server.Topics.Retained.Len()))
+	return deleted
+}
+
+// DeleteRetainedMatching removes the messages retained on the topics matched
+// by the filter and returns their topics, sorted.
+func DeleteRetainedMatching(server *mqtt.Server, filter string) []string {
+	topics := []string{}
+	for _, pk := range server.Topics.Messages(filter) {
+		if DeleteRetained(server, pk.TopicName) {
+			topics = append(topics, pk.TopicName)
+		}
+	}
+	slices.Sort(topics)
+	return topics
+}
@@ -0,0 +1,94 @@
+package lib
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RevocationList holds the SHA-256 fingerprints of revoked client
+// certificates, read from a file with one fingerprint per line. The file is
+// reloaded when it changes.
+type RevocationList struct {
+	Path         string
+	fingerprints map[string]bool
+	files        *fileWatcher
+	mutex        sync.RWMutex
+}
+
+func NewRevocationList(path string) (*RevocationList, error) {
+	list := &RevocationList{Path: path, files: newFileWatcher(path)}
+	err := list.Reload()
+	if err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+// Reload reads the file again. The previous fingerprints are kept when the
+// file is invalid.
+func (l *RevocationList) Reload() error {
+	modTimes := l.files.stat()
+	data, err := os.ReadFile(l.Path)
+	if err != nil {
+		return fmt.Errorf("failed to read revocation file: %w", err)
+	}
+
+	fingerprints, err := ParseFingerprints(data)
+	if err != nil {
+		return fmt.Errorf("invalid revocation file: %w", err)
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.fingerprints = fingerprints
+	l.files.loaded(modTimes)
+	return nil
+}
+
+// Watch polls the file every interval and reloads it when it was modified,
+// until stop is closed.
+func (l *RevocationList) Watch(interval time.Duration, stop <-chan struct{}) {
+	watchFiles(interval, stop, l.files.changed, l.Reload, "revocation list", "file", l.Path)
+}
+
+// Revoked reports whether the certificate fingerprint is listed.
+func (l *RevocationList) Revoked(fingerprint string) bool {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+
+	return l.fingerprints[fingerprint]
+}
+
+// ParseFingerprints reads hex encoded SHA-256 fingerprints, one per line.
+// Colons are ignored and case does not matter, so the output of
+// "openssl x509 -fingerprint -sha256" can be used as is. Blank lines and
+// lines starting with # are ignored.
+func ParseFingerprints(data []byte) (map[string]bool, error) {
+	fingerprints := make(map[string]bool)
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for number := 1; scanner.Scan(); number++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if _, value, ok := strings.Cut(line, "="); ok {
+			line = value
+		}
+
+		fingerprint := strings.ToLower(strings.ReplaceAll(line, ":", ""))
+		decoded, err := hex.DecodeString(fingerprint)
+		if err != nil || len(decoded) != 32 {
+			return nil, fmt.Errorf("line %d: invalid SHA-256 fingerprint", number)
+		}
+		fingerprints[fingerprint] = true
+	}
+	return fingerprints, scanner.Err()
+}
@@ -1,13 +1,90 @@
 package lib
 
-import "regexp"
+import (
+	"regexp"
+	"slices"
+	"strings"
+)
 
 type Route struct {
-	Name    string `yaml:"name"`
-	Pattern string `yaml:"pattern"`
-	URL     string `yaml:"url"`
+	Name      string            `yaml:"name"`
+	Pattern   string            `yaml:"pattern"`
+	URL       string            `yaml:"url"`
+	Headers   map[string]string `yaml:"headers"`
+	Listeners []string          `yaml:"listeners"`
+	Usernames []string          `yaml:"usernames"`
 }
 
 func (r *Route) Match(topic string) (ok bool, err error) {
 	return regexp.MatchString(r.Pattern, topic)
 }
+
+// MatchListener reports whether messages received on the named listener may
+// use this route. A route without listeners accepts all of them.
+func (r *Route) MatchListener(listener string) bool {
+	return len(r.Listeners) == 0 || slices.Contains(r.Listeners, listener)
+}
+
+// MatchUsername reports whether messages of the username may use this
+// route. The usernames are anchored regular expressions, and a route without
+// usernames accepts everyone.
+func (r *Route) MatchUsername(username string) bool {
+	if len(r.Usernames) == 0 {
+		return true
+	}
+	for _, pattern := range r.Usernames {
+		ok, err := regexp.MatchString("^(?:"+pattern+")$", username)
+		if err == nil && ok {
+			return true
+		}
+	}
+	return false
+}
+
+// ExpandHeader replaces the {topic}, {client_id}, {username}, {listener},
+// {cert_cn}, {cert_subject} and {cert_fingerprint} placeholders of a header
+// value with the details of the publishing client, which may be nil.
+func ExpandHeader(value string, topic string, client *Client) string {
+	if !strings.Contains(value, "{") {
+		return value
+	}
+
+	var clientID, username, listener, commonName, subject, fingerprint string
+	if client != nil {
+		clientID, username, listener = client.ID, client.Username, client.Listener
+		if client.Certificate != nil {
+			commonName = client.Certificate.CommonName
+			subject = client.Certificate.Subject
+			fingerprint = client.Certificate.Fingerprint
+		}
+	}
+
+	return strings.NewReplacer(
+		"{topic}", topic,
+		"{client_id}", clientID,
+		"{username}", username,
+		"{listener}", listener,
+		"{cert_cn}", commonName,
+		"{cert_subject}", subject,
+		"{cert_fingerprint}", fingerprint,
+	).Replace(value)
+}
+
+// Interpolate rewrites the URL and header values of the route with expand.
+func (r *Route) Interpolate(expand func(string) (string, error)) error {
+	var err error
+
+	r.URL, err = expand(r.URL)
+	if err != nil {
+		return err
+	}
+
+	for name, value := range r.Headers {
+		r.Headers[name], err = expand(value)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
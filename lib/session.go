@@ -0,0 +1,80 @@
+package lib
+
+import (
+	"errors"
+	"strings"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+)
+
+// sharePrefix starts the filters of shared subscriptions.
+const sharePrefix = "$share/"
+
+// SessionSettings shape the MQTT session of a client. They are returned by
+// the authorize endpoint at connect time. Zero values keep the broker
+// defaults.
+type SessionSettings struct {
+	// MaxKeepalive is the longest keepalive in seconds.
+	MaxKeepalive uint16 `json:"max_keepalive,omitempty"`
+	// SessionExpiry is the longest session expiry interval in seconds.
+	SessionExpiry *uint32 `json:"session_expiry,omitempty"`
+	// ReceiveMaximum is how many QoS 1 and 2 publications the client may
+	// send without waiting for their acknowledgement.
+	ReceiveMaximum uint16 `json:"receive_maximum,omitempty"`
+	// MaxPacketSize is the largest packet the client may send, in bytes.
+	MaxPacketSize uint32 `json:"max_packet_size,omitempty"`
+	// ClientID replaces the client ID sent by the client.
+	ClientID string `json:"client_id,omitempty"`
+	// TopicPrefix is prepended to every topic of the client, and stripped
+	// from the publications it receives.
+	TopicPrefix string `json:"topic_prefix,omitempty"`
+}
+
+// IsEmpty reports whether the settings change nothing.
+func (s *SessionSettings) IsEmpty() bool {
+	return *s == SessionSettings{}
+}
+
+// Validate checks that the topic prefix is usable in topic names.
+func (s *SessionSettings) Validate() error {
+	if strings.ContainsAny(s.TopicPrefix, "+#") {
+		return errors.New("topic prefix must not contain wildcards")
+	}
+	if strings.HasPrefix(s.TopicPrefix, "$") {
+		return errors.New("topic prefix must not start with $")
+	}
+	return nil
+}
+
+// PrefixTopic prepends the topic prefix to a topic name.
+func (s *SessionSettings) PrefixTopic(topic string) string {
+	return s.TopicPrefix + topic
+}
+
+// PrefixFilter prepends the topic prefix to a topic filter, after the group
+// of shared subscriptions.
+func (s *SessionSettings) PrefixFilter(filter string) string {
+	if group, ok := strings.CutPrefix(filter, sharePrefix); ok {
+		name, rest, found := strings.Cut(group, "/")
+		if found {
+			return sharePrefix + name + "/" + s.TopicPrefix + rest
+		}
+	}
+	return s.TopicPrefix + filter
+}
+
+// StripTopic removes the topic prefix from a topic name.
+func (s *SessionSettings) StripTopic(topic string) string {
+	return strings.TrimPrefix(topic, s.TopicPrefix)
+}
+
+// Disconnect closes the session of a client. MQTT 5 clients are told why
+// with a DISCONNECT packet, which MQTT 3 does not have.
+func Disconnect(server *mqtt.Server, cl *mqtt.Client, code packets.Code) {
+	if cl.Properties.ProtocolVersion < 5 {
+		cl.Stop(code)
+		return
+	}
+	server.DisconnectClient(cl, code)
+}
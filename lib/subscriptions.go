@@ -0,0 +1,81 @@
+package lib
+
+import (
+	"slices"
+	"strings"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+)
+
+// ClientSubscription is a subscription of a client, connected or with a
+// session kept after it disconnected.
+type ClientSubscription struct {
+	ClientID  string `json:"client_id"`
+	Username  string `json:"username"`
+	Connected bool   `json:"connected"`
+	Subscription
+}
+
+// Subscriptions returns the subscriptions receiving any topic matched by the
+// filter, or all subscriptions when it is empty, sorted by client ID and
+// filter. Topic names are looked up in the topic index of the broker,
+// filters in the subscriptions of every session, so that "sensors/#" finds
+// "sensors/+/temp" as well as "#".
+func Subscriptions(server *mqtt.Server, filter string) []ClientSubscription {
+	subs := []ClientSubscription{}
+	add := func(cl *mqtt.Client, sub packets.Subscription) {
+		if cl.Net.Inline {
+			return
+		}
+		subs = append(subs, ClientSubscription{
+			ClientID:     cl.ID,
+			Username:     string(cl.Properties.Username),
+			Connected:    !cl.Closed(),
+			Subscription: NewSubscription(sub, sub.Qos),
+		})
+	}
+
+	if filter != "" && !strings.ContainsAny(filter, "+#") {
+		subscribers := server.Topics.Subscribers(filter)
+		for id, sub := range subscribers.Subscriptions {
+			if cl, ok := server.Clients.Get(id); ok {
+				add(cl, sub)
+			}
+		}
+		for _, group := range subscribers.Shared {
+			for id, sub := range group {
+				if cl, ok := server.Clients.Get(id); ok {
+					add(cl, sub)
+				}
+			}
+		}
+	} else {
+		for _, cl := range server.Clients.GetAll() {
+			for _, sub := range cl.State.Subscriptions.GetAll() {
+				if filter == "" || OverlapsFilter(sharedFilterTopics(sub.Filter), filter) {
+					add(cl, sub)
+				}
+			}
+		}
+	}
+
+	slices.SortFunc(subs, func(a, b ClientSubscription) int {
+		if a.ClientID != b.ClientID {
+			return strings.Compare(a.ClientID, b.ClientID)
+		}
+		return strings.Compare(a.Filter, b.Filter)
+	})
+	return subs
+}
+
+// sharedFilterTopics returns the filter of the topics of a shared
+// subscription, without its group.
+func sharedFilterTopics(filter string) string {
+	if rest, ok := strings.CutPrefix(filter, sharePrefix); ok {
+		if _, topics, found := strings.Cut(rest, "/"); found {
+			return topics
+		}
+	}
+	return filter
+}
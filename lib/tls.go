@@ -0,0 +1,150 @@
+package lib
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CertificateLoader holds the server certificate and the client CA bundle of
+// a TLS listener and reloads them when the files change.
+type CertificateLoader struct {
+	CertFile     string
+	KeyFile      string
+	ClientCAFile string
+	certificate  *tls.Certificate
+	clientCAs    *x509.CertPool
+	files        *fileWatcher
+	mutex        sync.RWMutex
+}
+
+func NewCertificateLoader(certFile string, keyFile string, clientCAFile string) (*CertificateLoader, error) {
+	loader := &CertificateLoader{
+		CertFile:     certFile,
+		KeyFile:      keyFile,
+		ClientCAFile: clientCAFile,
+		files:        newFileWatcher(certFile, keyFile, clientCAFile),
+	}
+	err := loader.Reload()
+	if err != nil {
+		return nil, err
+	}
+	return loader, nil
+}
+
+// Reload reads the certificate, key and client CA files again. The previous
+// material is kept when any of them is invalid.
+func (l *CertificateLoader) Reload() error {
+	modTimes := l.files.stat()
+	certificate, err := tls.LoadX509KeyPair(l.CertFile, l.KeyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load certificate: %w", err)
+	}
+
+	var clientCAs *x509.CertPool
+	if l.ClientCAFile != "" {
+		data, err := os.ReadFile(l.ClientCAFile)
+		if err != nil {
+			return fmt.Errorf("failed to read client CA file: %w", err)
+		}
+		clientCAs = x509.NewCertPool()
+		if !clientCAs.AppendCertsFromPEM(data) {
+			return errors.New("no certificate found in client CA file")
+		}
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.certificate = &certificate
+	l.clientCAs = clientCAs
+	l.files.loaded(modTimes)
+	return nil
+}
+
+// Watch polls the files every interval and reloads them when one of them
+// was modified, until stop is closed.
+func (l *CertificateLoader) Watch(interval time.Duration, stop <-chan struct{}) {
+	watchFiles(interval, stop, l.files.changed, l.Reload, "certificates", "cert", l.CertFile)
+}
+
+// TLSConfig returns a configuration that always serves the most recently
+// loaded certificate and client CA bundle.
+func (l *CertificateLoader) TLSConfig(minVersion uint16, cipherSuites []uint16, clientAuth tls.ClientAuthType) *tls.Config {
+	base := &tls.Config{
+		MinVersion:   minVersion,
+		CipherSuites: cipherSuites,
+		ClientAuth:   clientAuth,
+	}
+
+	return &tls.Config{
+		MinVersion: minVersion,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			l.mutex.RLock()
+			defer l.mutex.RUnlock()
+
+			config := base.Clone()
+			config.Certificates = []tls.Certificate{*l.certificate}
+			config.ClientCAs = l.clientCAs
+			return config, nil
+		},
+	}
+}
+
+// ParseTLSVersion converts a version such as "1.2" to its crypto/tls value.
+func ParseTLSVersion(version string) (uint16, error) {
+	switch version {
+	case "", "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	case "1.1":
+		return tls.VersionTLS11, nil
+	case "1.0":
+		return tls.VersionTLS10, nil
+	}
+	return 0, fmt.Errorf("unknown TLS version %q", version)
+}
+
+// ParseCipherSuites converts a comma separated list of IANA cipher suite
+// names to their crypto/tls values. An empty list selects the Go defaults.
+func ParseCipherSuites(names string) ([]uint16, error) {
+	if names == "" {
+		return nil, nil
+	}
+
+	known := make(map[string]uint16)
+	for _, suite := range tls.CipherSuites() {
+		known[suite.Name] = suite.ID
+	}
+
+	suites := []uint16{}
+	for _, name := range strings.Split(names, ",") {
+		name = strings.TrimSpace(name)
+		id, ok := known[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown or insecure cipher suite %q", name)
+		}
+		suites = append(suites, id)
+	}
+	return suites, nil
+}
+
+// ParseClientAuth converts "none", "optional" or "require" to the matching
+// client certificate policy.
+func ParseClientAuth(mode string) (tls.ClientAuthType, error) {
+	switch mode {
+	case "", "none":
+		return tls.NoClientCert, nil
+	case "optional":
+		return tls.VerifyClientCertIfGiven, nil
+	case "require":
+		return tls.RequireAndVerifyClientCert, nil
+	}
+	return tls.NoClientCert, fmt.Errorf("unknown client auth mode %q", mode)
+}
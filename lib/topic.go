@@ -0,0 +1,83 @@
+package lib
+
+import "strings"
+
+// MatchTopic reports whether the MQTT topic filter matches the topic name.
+func MatchTopic(filter string, topic string) bool {
+	filterLevels := strings.Split(filter, "/")
+	topicLevels := strings.Split(topic, "/")
+
+	// Wildcards at the first level do not match topics starting with $.
+	if strings.HasPrefix(topic, "$") && len(filterLevels) > 0 && (filterLevels[0] == "#" || filterLevels[0] == "+") {
+		return false
+	}
+
+	for i, level := range filterLevels {
+		if level == "#" {
+			return true
+		}
+		if i >= len(topicLevels) {
+			return false
+		}
+		if level != "+" && level != topicLevels[i] {
+			return false
+		}
+	}
+
+	return len(filterLevels) == len(topicLevels)
+}
+
+// CoversFilter reports whether every topic matched by filter is also matched
+// by outer, e.g. "devices/#" covers "devices/+/state".
+func CoversFilter(outer string, filter string) bool {
+	outerLevels := strings.Split(outer, "/")
+	filterLevels := strings.Split(filter, "/")
+
+	for i, level := range outerLevels {
+		if level == "#" {
+			return true
+		}
+		if i >= len(filterLevels) {
+			return false
+		}
+		switch {
+		case filterLevels[i] == "#":
+			return false
+		case level == "+":
+			continue
+		case filterLevels[i] == "+" || level != filterLevels[i]:
+			return false
+		}
+	}
+
+	return len(outerLevels) == len(filterLevels)
+}
+
+// OverlapsFilter reports whether at least one topic is matched by both
+// filters, e.g. "#" overlaps "secret/+" and "+/state" overlaps "devices/#".
+func OverlapsFilter(a string, b string) bool {
+	aLevels := strings.Split(a, "/")
+	bLevels := strings.Split(b, "/")
+
+	// Wildcards at the first level do not match topics starting with $.
+	if strings.HasPrefix(a, "$") && isWildcard(bLevels[0]) || strings.HasPrefix(b, "$") && isWildcard(aLevels[0]) {
+		return false
+	}
+
+	for i := 0; i < len(aLevels) || i < len(bLevels); i++ {
+		switch {
+		// # also matches the parent level, e.g. "a/#" overlaps "a".
+		case i < len(aLevels) && aLevels[i] == "#", i < len(bLevels) && bLevels[i] == "#":
+			return true
+		case i >= len(aLevels) || i >= len(bLevels):
+			return false
+		case aLevels[i] != "+" && bLevels[i] != "+" && aLevels[i] != bLevels[i]:
+			return false
+		}
+	}
+	return true
+}
+
+func isWildcard(level string) bool {
+	return level == "+" || level == "#"
+}
@@ -0,0 +1,127 @@
+package lib
+
+import (
+	"container/list"
+	"math"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+)
+
+// topicRateWindow is the time over which the message rate of a topic is
+// averaged.
+const topicRateWindow = time.Minute
+
+// topicStatsMaxEntries bounds the tracked topics. The topic published the
+// longest ago is forgotten beyond.
+const topicStatsMaxEntries = 10000
+
+type topicStat struct {
+	topic    string
+	messages int64
+	last     time.Time
+	rate     float64
+}
+
+// rateAt returns the exponentially decayed message rate per second.
+func (s *topicStat) rateAt(now time.Time) float64 {
+	return s.rate * math.Exp(-now.Sub(s.last).Seconds()/topicRateWindow.Seconds())
+}
+
+// TopicStats tracks the publications per topic: how many there were, when
+// the last one happened and their rate over about a minute.
+type TopicStats struct {
+	topics map[string]*list.Element
+	// recent orders the stats from the most to the least recently
+	// published, so that the oldest is forgotten without a scan.
+	recent *list.List
+	mutex  sync.Mutex
+}
+
+func NewTopicStats() *TopicStats {
+	return &TopicStats{topics: make(map[string]*list.Element), recent: list.New()}
+}
+
+func (s *TopicStats) Publish(topic string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	now := time.Now()
+	element, ok := s.topics[topic]
+	if ok {
+		s.recent.MoveToFront(element)
+	} else {
+		if len(s.topics) >= topicStatsMaxEntries {
+			oldest := s.recent.Back()
+			s.recent.Remove(oldest)
+			delete(s.topics, oldest.Value.(*topicStat).topic)
+		}
+		element = s.recent.PushFront(&topicStat{topic: topic, last: now})
+		s.topics[topic] = element
+	}
+	stat := element.Value.(*topicStat)
+	stat.rate = stat.rateAt(now) + 1/topicRateWindow.Seconds()
+	stat.messages++
+	stat.last = now
+}
+
+// TopicActivity describes a topic that was published to or holds a
+// retained message.
+type TopicActivity struct {
+	Topic       string     `json:"topic"`
+	Subscribers int        `json:"subscribers"`
+	Messages    int64      `json:"messages"`
+	LastPublish *time.Time `json:"last_publish,omitempty"`
+	Rate        float64    `json:"rate"`
+	Retained    bool       `json:"retained"`
+}
+
+// Topics returns the activity of the topics matching the filter, sorted by
+// topic. Without a filter, every topic but those starting with $ is
+// returned, like with #. Subscribers and retained messages are looked up
+// in the topic index of the broker.
+func (s *TopicStats) Topics(index *mqtt.TopicsIndex, filter string) []TopicActivity {
+	now := time.Now()
+	activities := map[string]*TopicActivity{}
+
+	s.mutex.Lock()
+	for topic, element := range s.topics {
+		stat := element.Value.(*topicStat)
+		last := stat.last
+		activities[topic] = &TopicActivity{Topic: topic, Messages: stat.messages, LastPublish: &last, Rate: stat.rateAt(now)}
+	}
+	s.mutex.Unlock()
+
+	for topic := range index.Retained.GetAll() {
+		if _, ok := activities[topic]; !ok {
+			activities[topic] = &TopicActivity{Topic: topic}
+		}
+	}
+
+	topics := []TopicActivity{}
+	for topic, activity := range activities {
+		if filter == "" && strings.HasPrefix(topic, "$") || filter != "" && !MatchTopic(filter, topic) {
+			continue
+		}
+		_, activity.Retained = index.Retained.Get(topic)
+		activity.Subscribers = countSubscribers(index.Subscribers(topic))
+		topics = append(topics, *activity)
+	}
+	slices.SortFunc(topics, func(a, b TopicActivity) int {
+		return strings.Compare(a.Topic, b.Topic)
+	})
+	return topics
+}
+
+// countSubscribers counts the subscriptions receiving a topic, every member
+// of a shared subscription group included.
+func countSubscribers(subs *mqtt.Subscribers) int {
+	count := len(subs.Subscriptions) + len(subs.InlineSubscriptions)
+	for _, group := range subs.Shared {
+		count += len(group)
+	}
+	return count
+}
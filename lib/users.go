@@ -0,0 +1,280 @@
+package lib
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	HashBcrypt   = "bcrypt"
+	HashArgon2id = "argon2id"
+)
+
+// Argon2id parameters of new hashes, as recommended by RFC 9106.
+const (
+	argon2Time    = 3
+	argon2Memory  = 64 * 1024
+	argon2Threads = 4
+	argon2KeyLen  = 32
+	argon2SaltLen = 16
+)
+
+// User is an entry of the users file.
+type User struct {
+	Username string
+	Hash     string
+	Groups   []string
+}
+
+// UserFile authenticates clients against a file of "username:hash[:groups]"
+// lines, with bcrypt or argon2id hashes and comma separated groups. The file
+// is reloaded when it changes.
+type UserFile struct {
+	Path  string
+	users map[string]User
+	files *fileWatcher
+	mutex sync.RWMutex
+}
+
+func NewUserFile(path string) (*UserFile, error) {
+	file := &UserFile{Path: path, files: newFileWatcher(path)}
+	err := file.Reload()
+	if err != nil {
+		return nil, err
+	}
+	return file, nil
+}
+
+// Reload reads the file again. The previous users are kept when the file
+// is invalid.
+func (f *UserFile) Reload() error {
+	modTimes := f.files.stat()
+	data, err := os.ReadFile(f.Path)
+	if err != nil {
+		return fmt.Errorf("failed to read users file: %w", err)
+	}
+
+	entries, err := ParseUsers(data)
+	if err != nil {
+		return fmt.Errorf("invalid users file: %w", err)
+	}
+	users := make(map[string]User)
+	for _, user := range entries {
+		users[user.Username] = user
+	}
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	f.users = users
+	f.files.loaded(modTimes)
+	return nil
+}
+
+// Watch polls the file every interval and reloads it when it was modified,
+// until stop is closed.
+func (f *UserFile) Watch(interval time.Duration, stop <-chan struct{}) {
+	watchFiles(interval, stop, f.files.changed, f.Reload, "users", "file", f.Path)
+}
+
+// Lookup returns the entry of the username.
+func (f *UserFile) Lookup(username string) (User, bool) {
+	f.mutex.RLock()
+	defer f.mutex.RUnlock()
+
+	user, ok := f.users[username]
+	return user, ok
+}
+
+// Authenticate abstains for usernames missing from the file, and otherwise
+// allows or denies the client depending on its password.
+func (f *UserFile) Authenticate(request AuthRequest) (AuthResult, *Identity, error) {
+	user, ok := f.Lookup(request.Username)
+	if !ok {
+		return AuthAbstain, nil, nil
+	}
+	if !VerifyPassword(user.Hash, request.Password) {
+		return AuthDeny, nil, nil
+	}
+	return AuthAllow, &Identity{Username: user.Username, Groups: user.Groups}, nil
+}
+
+// ParseUsers reads the lines of a users file. Blank lines and lines starting
+// with # are ignored.
+func ParseUsers(data []byte) ([]User, error) {
+	users := []User{}
+	seen := make(map[string]bool)
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for number := 1; scanner.Scan(); number++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		user, err := parseUser(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", number, err)
+		}
+		if seen[user.Username] {
+			return nil, fmt.Errorf("line %d: duplicate user %q", number, user.Username)
+		}
+		seen[user.Username] = true
+		users = append(users, user)
+	}
+	return users, scanner.Err()
+}
+
+func parseUser(line string) (User, error) {
+	fields := strings.Split(line, ":")
+	if len(fields) < 2 || len(fields) > 3 {
+		return User{}, errors.New("expected username:hash[:groups]")
+	}
+
+	user := User{Username: fields[0], Hash: fields[1]}
+	if user.Username == "" {
+		return User{}, errors.New("empty username")
+	}
+	if !strings.HasPrefix(user.Hash, "$2") && !strings.HasPrefix(user.Hash, "$argon2id$") {
+		return User{}, fmt.Errorf("unsupported hash for user %q", user.Username)
+	}
+	if len(fields) == 3 && fields[2] != "" {
+		for _, group := range strings.Split(fields[2], ",") {
+			user.Groups = append(user.Groups, strings.TrimSpace(group))
+		}
+	}
+	return user, nil
+}
+
+func (u User) String() string {
+	line := u.Username + ":" + u.Hash
+	if len(u.Groups) > 0 {
+		line += ":" + strings.Join(u.Groups, ",")
+	}
+	return line
+}
+
+// HashPassword hashes the password with bcrypt or argon2id.
+func HashPassword(password string, algorithm string) (string, error) {
+	switch algorithm {
+	case HashBcrypt:
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+		return string(hash), err
+	case HashArgon2id:
+		salt := make([]byte, argon2SaltLen)
+		_, err := rand.Read(salt)
+		if err != nil {
+			return "", err
+		}
+		key := argon2.IDKey([]byte(password), salt, argon2Time, argon2Memory, argon2Threads, argon2KeyLen)
+		return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+			argon2.Version, argon2Memory, argon2Time, argon2Threads,
+			base64.RawStdEncoding.EncodeToString(salt),
+			base64.RawStdEncoding.EncodeToString(key)), nil
+	}
+	return "", fmt.Errorf("unknown hash algorithm %q", algorithm)
+}
+
+// VerifyPassword checks the password against a bcrypt or argon2id hash.
+func VerifyPassword(hash string, password string) bool {
+	if !strings.HasPrefix(hash, "$argon2id$") {
+		return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+	}
+
+	// $argon2id$v=19$m=65536,t=3,p=4$salt$key
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 {
+		return false
+	}
+	var version int
+	var memory, iterations uint32
+	var threads uint8
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return false
+	}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &memory, &iterations, &threads); err != nil {
+		return false
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return false
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil || len(key) == 0 {
+		return false
+	}
+
+	actual := argon2.IDKey([]byte(password), salt, iterations, memory, threads, uint32(len(key)))
+	return subtle.ConstantTimeCompare(actual, key) == 1
+}
+
+// SetUser adds the user to the users file, or replaces the entry with the
+// same username. Other lines are kept as they are. The file is created when
+// it does not exist.
+func SetUser(path string, user User) error {
+	if user.Username == "" || strings.ContainsAny(user.Username, ":\n") {
+		return fmt.Errorf("invalid username %q", user.Username)
+	}
+	for _, group := range user.Groups {
+		if group == "" || strings.ContainsAny(group, ":,\n") {
+			return fmt.Errorf("invalid group %q", group)
+		}
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if _, err := ParseUsers(data); err != nil {
+		return fmt.Errorf("invalid users file: %w", err)
+	}
+
+	lines := []string{}
+	replaced := false
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(strings.TrimSpace(line), user.Username+":") {
+			line = user.String()
+			replaced = true
+		}
+		lines = append(lines, line)
+	}
+	if !replaced {
+		lines = append(lines, user.String())
+	}
+
+	return writeFileAtomic(path, []byte(strings.Join(lines, "\n")+"\n"))
+}
+
+// writeFileAtomic writes to a temporary file first and renames it, so a
+// running broker never reads a partial file.
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+"-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Close()
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,201 @@
+package lib
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/mochi-mqtt/server/v2/listeners"
+)
+
+// WebsocketListener accepts MQTT over WebSocket connections on a single path
+// and only from the allowed origins.
+type WebsocketListener struct {
+	id             string
+	address        string
+	path           string
+	allowedOrigins []string
+	tlsConfig      *tls.Config
+	trusted        []*net.IPNet
+	proxy          bool
+	listen         net.Listener
+	server         *http.Server
+	upgrader       *websocket.Upgrader
+	log            *slog.Logger
+	establish      listeners.EstablishFn
+	end            uint32
+	mutex          sync.Mutex
+}
+
+// NewWebsocketListener creates a listener. An empty origin list only accepts
+// same-origin requests, "*" accepts any origin.
+func NewWebsocketListener(id string, address string, path string, allowedOrigins []string, tlsConfig *tls.Config) *WebsocketListener {
+	l := &WebsocketListener{
+		id:             id,
+		address:        address,
+		path:           path,
+		allowedOrigins: allowedOrigins,
+		tlsConfig:      tlsConfig,
+	}
+	l.upgrader = &websocket.Upgrader{
+		Subprotocols: []string{"mqtt"},
+	}
+	if len(allowedOrigins) > 0 {
+		l.upgrader.CheckOrigin = l.checkOrigin
+	}
+	return l
+}
+
+// SetProxyProtocol enables PROXY headers from the trusted peers.
+func (l *WebsocketListener) SetProxyProtocol(trusted []*net.IPNet) {
+	l.proxy = true
+	l.trusted = trusted
+}
+
+func (l *WebsocketListener) ID() string {
+	return l.id
+}
+
+func (l *WebsocketListener) Address() string {
+	if l.listen != nil {
+		return l.listen.Addr().String()
+	}
+	return l.address
+}
+
+func (l *WebsocketListener) Protocol() string {
+	if l.tlsConfig != nil {
+		return "wss"
+	}
+	return "ws"
+}
+
+func (l *WebsocketListener) Init(log *slog.Logger) error {
+	l.log = log
+
+	listen, err := net.Listen("tcp", l.address)
+	if err != nil {
+		return err
+	}
+	l.listen = wrapListener(listen, l.tlsConfig, l.proxy, l.trusted)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(l.path, l.handler)
+	l.server = &http.Server{
+		Handler:      mux,
+		ReadTimeout:  60 * time.Second,
+		WriteTimeout: 60 * time.Second,
+	}
+
+	return nil
+}
+
+func (l *WebsocketListener) Serve(establish listeners.EstablishFn) {
+	l.establish = establish
+
+	err := l.server.Serve(l.listen)
+	if err != nil && atomic.LoadUint32(&l.end) == 0 {
+		l.log.Error("Websocket listener stopped", "err", err, "listener", l.id)
+	}
+}
+
+func (l *WebsocketListener) Close(closeClients listeners.CloseFn) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if atomic.CompareAndSwapUint32(&l.end, 0, 1) {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_ = l.server.Shutdown(ctx)
+	}
+
+	closeClients(l.id)
+}
+
+func (l *WebsocketListener) handler(w http.ResponseWriter, r *http.Request) {
+	c, err := l.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		l.log.Debug("Websocket upgrade failed", "err", err, "origin", r.Header.Get("Origin"))
+		return
+	}
+	defer c.Close()
+
+	err = l.establish(l.id, &websocketConn{Conn: c.UnderlyingConn(), c: c})
+	if err != nil {
+		l.log.Warn("Websocket client stopped", "err", err)
+	}
+}
+
+func (l *WebsocketListener) checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	for _, allowed := range l.allowedOrigins {
+		if allowed == "*" || strings.EqualFold(allowed, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// websocketConn carries MQTT packets in binary WebSocket messages.
+type websocketConn struct {
+	net.Conn
+	c *websocket.Conn
+	r io.Reader
+}
+
+func (ws *websocketConn) Read(p []byte) (int, error) {
+	if ws.r == nil {
+		op, r, err := ws.c.NextReader()
+		if err != nil {
+			return 0, err
+		}
+		if op != websocket.BinaryMessage {
+			return 0, listeners.ErrInvalidMessage
+		}
+		ws.r = r
+	}
+
+	n := 0
+	for n < len(p) {
+		br, err := ws.r.Read(p[n:])
+		n += br
+		if err != nil {
+			ws.r = nil
+			if errors.Is(err, io.EOF) {
+				err = nil
+			}
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+func (ws *websocketConn) Write(p []byte) (int, error) {
+	err := ws.c.WriteMessage(websocket.BinaryMessage, p)
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (ws *websocketConn) Close() error {
+	return ws.Conn.Close()
+}
+
+// NetConn returns the connection carrying the WebSocket, so that the client
+// certificate can be read from it.
+func (ws *websocketConn) NetConn() net.Conn {
+	return ws.Conn
+}
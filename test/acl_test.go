@@ -0,0 +1,327 @@
+package test
+
+import (
+	"encoding/json"
+	"fmt"
+	"mqtt2http/broker"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+func TestACLEndpointIsEnforcedAndCached(t *testing.T) {
+	received := make(chan []byte, 3)
+
+	clientUsername := "testClient"
+	clientPassword := "testPassword"
+
+	authSrv := createAuthSrv(t, clientUsername, clientPassword)
+	defer authSrv.Close()
+
+	pubSrv := createPubSrv(t, received)
+	defer pubSrv.Close()
+
+	var calls atomic.Int32
+	aclSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		var req struct {
+			ClientID string `json:"client_id"`
+			Username string `json:"username"`
+			Topic    string `json:"topic"`
+			Action   string `json:"action"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Errorf("acl: invalid body: %v", err)
+		}
+		if req.ClientID != "acl-test" || req.Username != clientUsername || req.Action != "write" {
+			t.Errorf("acl: unexpected request %+v", req)
+		}
+		if req.Topic != "allowed" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer aclSrv.Close()
+
+	cfg := &broker.BrokerConfig{
+		AuthorizeURL: authSrv.URL,
+		PublishURL:   pubSrv.URL,
+		ContentType:  "application/json",
+		ACLURL:       aclSrv.URL,
+		ACLCacheTTL:  time.Minute,
+	}
+	cfg.Load()
+	startBroker(t, cfg)
+
+	opts := mqtt.NewClientOptions().
+		AddBroker("tcp://" + cfg.TCPAddr).
+		SetClientID("acl-test").
+		SetUsername(clientUsername).
+		SetPassword(clientPassword).
+		SetConnectTimeout(2 * time.Second)
+
+	client := mqtt.NewClient(opts)
+	if tok := client.Connect(); !tok.WaitTimeout(5*time.Second) || tok.Error() != nil {
+		t.Fatalf("connect failed: %v", tok.Error())
+	}
+	t.Cleanup(func() { client.Disconnect(250) })
+
+	for _, topic := range []string{"denied", "allowed", "allowed"} {
+		if tok := client.Publish(topic, 0, false, []byte(topic)); !tok.WaitTimeout(5*time.Second) || tok.Error() != nil {
+			t.Fatalf("publish failed: %v", tok.Error())
+		}
+	}
+
+	for range 2 {
+		select {
+		case got := <-received:
+			if string(got) != "allowed" {
+				t.Fatalf("denied message was forwarded: %s", got)
+			}
+		case <-time.After(3 * time.Second):
+			t.Fatal("timed out waiting for forwarded request")
+		}
+	}
+
+	if got := calls.Load(); got != 2 {
+		t.Fatalf("expected 2 ACL requests thanks to the cache, got %d", got)
+	}
+}
+
+func TestACLFileRulesWithPlaceholders(t *testing.T) {
+	received := make(chan []byte, 3)
+
+	clientUsername := "dev1"
+	clientPassword := "testPassword"
+
+	authSrv := createAuthSrv(t, clientUsername, clientPassword)
+	defer authSrv.Close()
+
+	pubSrv := createPubSrv(t, received)
+	defer pubSrv.Close()
+
+	aclPath := filepath.Join(t.TempDir(), "acl.yaml")
+	writeACL := func(rules string) {
+		if err := os.WriteFile(aclPath, []byte(rules), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeACL(`
+default: deny
+rules:
+  - permission: allow
+    action: readwrite
+    topics: ['devices/%u/#']
+`)
+
+	cfg := &broker.BrokerConfig{
+		AuthorizeURL: authSrv.URL,
+		PublishURL:   pubSrv.URL,
+		ContentType:  "application/json",
+		ACLFilePath:  aclPath,
+	}
+	cfg.Load()
+	b := startBroker(t, cfg)
+
+	opts := mqtt.NewClientOptions().
+		AddBroker("tcp://" + cfg.TCPAddr).
+		SetClientID("acl-file-test").
+		SetUsername(clientUsername).
+		SetPassword(clientPassword).
+		SetConnectTimeout(2 * time.Second)
+
+	client := mqtt.NewClient(opts)
+	if tok := client.Connect(); !tok.WaitTimeout(5*time.Second) || tok.Error() != nil {
+		t.Fatalf("connect failed: %v", tok.Error())
+	}
+	t.Cleanup(func() { client.Disconnect(250) })
+
+	subscribe := func(filter string) byte {
+		tok := client.Subscribe(filter, 0, nil)
+		if !tok.WaitTimeout(5*time.Second) || tok.Error() != nil {
+			t.Fatalf("subscribe failed: %v", tok.Error())
+		}
+		return tok.(*mqtt.SubscribeToken).Result()[filter]
+	}
+	if code := subscribe("devices/dev1/+"); code != 0 {
+		t.Fatalf("expected subscription to own devices to be granted, got %#x", code)
+	}
+	if code := subscribe("devices/#"); code != 0x80 {
+		t.Fatalf("expected subscription to all devices to be rejected, got %#x", code)
+	}
+
+	publish := func(topic string) {
+		if tok := client.Publish(topic, 0, false, []byte(topic)); !tok.WaitTimeout(5*time.Second) || tok.Error() != nil {
+			t.Fatalf("publish failed: %v", tok.Error())
+		}
+	}
+	expect := func(want string) {
+		select {
+		case got := <-received:
+			if string(got) != want {
+				t.Fatalf("unexpected forwarded body %s, want %s", got, want)
+			}
+		case <-time.After(3 * time.Second):
+			t.Fatal("timed out waiting for forwarded request")
+		}
+	}
+
+	publish("devices/dev2/state")
+	publish("devices/dev1/state")
+	expect("devices/dev1/state")
+
+	writeACL(`
+default: allow
+`)
+	b.Reload()
+
+	publish("devices/dev2/state")
+	expect("devices/dev2/state")
+}
+
+func TestACLDenyRulesBlockOverlappingSubscriptions(t *testing.T) {
+	authSrv := createAuthSrv(t, "dev1", "testPassword")
+	defer authSrv.Close()
+
+	aclPath := filepath.Join(t.TempDir(), "acl.yaml")
+	rules := `
+default: allow
+rules:
+  - permission: deny
+    action: read
+    topics: ['secret/#']
+`
+	if err := os.WriteFile(aclPath, []byte(rules), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := &broker.BrokerConfig{AuthorizeURL: authSrv.URL, ACLFilePath: aclPath}
+	cfg.Load()
+	startBroker(t, cfg)
+
+	opts := mqtt.NewClientOptions().
+		AddBroker("tcp://" + cfg.TCPAddr).
+		SetClientID("acl-deny-test").
+		SetUsername("dev1").
+		SetPassword("testPassword").
+		SetConnectTimeout(2 * time.Second)
+
+	client := mqtt.NewClient(opts)
+	if tok := client.Connect(); !tok.WaitTimeout(5*time.Second) || tok.Error() != nil {
+		t.Fatalf("connect failed: %v", tok.Error())
+	}
+	t.Cleanup(func() { client.Disconnect(250) })
+
+	expected := map[string]byte{
+		"#":                     0x80,
+		"+/+":                   0x80,
+		"secret/keys":           0x80,
+		"$share/group/secret/#": 0x80,
+		"public/#":              0,
+		"+/state":               0x80,
+		"devices/+/state":       0,
+		"$SYS/broker/clients/+": 0,
+	}
+	for filter, want := range expected {
+		tok := client.Subscribe(filter, 0, nil)
+		if !tok.WaitTimeout(5*time.Second) || tok.Error() != nil {
+			t.Fatalf("subscribe failed: %v", tok.Error())
+		}
+		// paho keys the results of shared subscriptions without their group.
+		for _, code := range tok.(*mqtt.SubscribeToken).Result() {
+			if code != want {
+				t.Fatalf("expected %#x for a subscription to %s, got %#x", want, filter, code)
+			}
+		}
+	}
+}
+
+func TestPermissionsFromAuthorizeResponse(t *testing.T) {
+	received := make(chan []byte, 3)
+
+	authSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"publish": ["devices/%u/#"], "subscribe": ["cmd/%u"], "max_qos": 0, "retain": false}`))
+	}))
+	defer authSrv.Close()
+
+	pubSrv := createPubSrv(t, received)
+	defer pubSrv.Close()
+
+	cfg := &broker.BrokerConfig{
+		AuthorizeURL: authSrv.URL,
+		PublishURL:   pubSrv.URL,
+		ContentType:  "application/json",
+		APIPassword:  "secret",
+	}
+	cfg.Load()
+	startBroker(t, cfg)
+
+	opts := mqtt.NewClientOptions().
+		AddBroker("tcp://" + cfg.TCPAddr).
+		SetClientID("perm-test").
+		SetUsername("dev1").
+		SetConnectTimeout(2 * time.Second)
+
+	client := mqtt.NewClient(opts)
+	if tok := client.Connect(); !tok.WaitTimeout(5*time.Second) || tok.Error() != nil {
+		t.Fatalf("connect failed: %v", tok.Error())
+	}
+	t.Cleanup(func() { client.Disconnect(250) })
+
+	subscribe := func(filter string) byte {
+		tok := client.Subscribe(filter, 1, nil)
+		if !tok.WaitTimeout(5*time.Second) || tok.Error() != nil {
+			t.Fatalf("subscribe failed: %v", tok.Error())
+		}
+		// Shared subscriptions are keyed without their group.
+		for _, code := range tok.(*mqtt.SubscribeToken).Result() {
+			return code
+		}
+		t.Fatalf("no result for %s", filter)
+		return 0
+	}
+	if code := subscribe("cmd/dev1"); code != 0 {
+		t.Fatalf("expected subscription granted with QoS 0, got %#x", code)
+	}
+	if code := subscribe("cmd/dev2"); code != 0x80 {
+		t.Fatalf("expected subscription to be rejected, got %#x", code)
+	}
+	if code := subscribe("$share/workers/cmd/dev1"); code != 0 {
+		t.Fatalf("expected shared subscription granted with QoS 0, got %#x", code)
+	}
+	if code := subscribe("$share/workers/cmd/dev2"); code != 0x80 {
+		t.Fatalf("expected shared subscription to be rejected, got %#x", code)
+	}
+
+	publish := func(topic string, retained bool) {
+		if tok := client.Publish(topic, 0, retained, []byte(topic)); !tok.WaitTimeout(5*time.Second) || tok.Error() != nil {
+			t.Fatalf("publish failed: %v", tok.Error())
+		}
+	}
+	publish("devices/dev2/state", false)
+	publish("devices/dev1/retained", true)
+	publish("devices/dev1/state", false)
+
+	select {
+	case got := <-received:
+		if string(got) != "devices/dev1/state" {
+			t.Fatalf("unexpected forwarded body %s", got)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("timed out waiting for forwarded request")
+	}
+
+	_, content := apiRequest(t, http.MethodGet, fmt.Sprintf("http://%s/clients", cfg.HTTPAddr), "secret", nil)
+	if !strings.Contains(string(content), `"permissions":{"publish":["devices/%u/#"],"subscribe":["cmd/%u"],"max_qos":0,"retain":false}`) {
+		t.Fatalf("permissions missing from the clients endpoint, got %s", content)
+	}
+}
@@ -0,0 +1,152 @@
+package test
+
+import (
+	"fmt"
+	"mqtt2http/broker"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+func TestAuthorizeAnswersAreCached(t *testing.T) {
+	var calls atomic.Int32
+	authSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		username, password, _ := r.BasicAuth()
+		switch {
+		case username == "nostore":
+			w.Header().Set("Cache-Control", "no-store")
+			w.WriteHeader(http.StatusOK)
+		case password != "testPassword":
+			w.WriteHeader(http.StatusUnauthorized)
+		default:
+			w.WriteHeader(http.StatusOK)
+		}
+	}))
+	defer authSrv.Close()
+
+	urlPath := filepath.Join(t.TempDir(), "authorize-url")
+	if err := os.WriteFile(urlPath, []byte(authSrv.URL+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := &broker.BrokerConfig{
+		AuthorizeURLFile: urlPath,
+		AuthCacheTTL:     time.Minute,
+		AuthNegativeTTL:  time.Minute,
+		APIPassword:      "secret",
+	}
+	cfg.Load()
+	b := startBroker(t, cfg)
+
+	connect := func(username string, password string) error {
+		opts := mqtt.NewClientOptions().
+			AddBroker("tcp://" + cfg.TCPAddr).
+			SetClientID("cache-test").
+			SetUsername(username).
+			SetPassword(password).
+			SetProtocolVersion(4).
+			SetConnectTimeout(2 * time.Second)
+
+		client := mqtt.NewClient(opts)
+		tok := client.Connect()
+		if !tok.WaitTimeout(5 * time.Second) {
+			t.Fatal("connect timed out")
+		}
+		if tok.Error() == nil {
+			client.Disconnect(250)
+		}
+		return tok.Error()
+	}
+	expectCalls := func(want int32) {
+		t.Helper()
+		if got := calls.Load(); got != want {
+			t.Fatalf("expected %d authorize requests, got %d", want, got)
+		}
+	}
+
+	for range 2 {
+		if err := connect("testClient", "testPassword"); err != nil {
+			t.Fatalf("connect failed: %v", err)
+		}
+	}
+	expectCalls(1)
+
+	for range 2 {
+		if err := connect("testClient", "wrong"); err == nil {
+			t.Fatal("expected connection with a wrong password to fail")
+		}
+	}
+	expectCalls(2)
+
+	for range 2 {
+		if err := connect("nostore", "testPassword"); err != nil {
+			t.Fatalf("connect failed: %v", err)
+		}
+	}
+	expectCalls(4)
+
+	code, content := apiRequest(t, http.MethodDelete, fmt.Sprintf("http://%s/auth/cache", cfg.HTTPAddr), "secret", nil)
+	if code != http.StatusOK || string(content) != `{"flushed":2}` {
+		t.Fatalf("unexpected flush answer %d %s", code, content)
+	}
+
+	if err := connect("testClient", "testPassword"); err != nil {
+		t.Fatalf("connect failed: %v", err)
+	}
+	expectCalls(5)
+
+	// A reload keeps the answers of the same endpoint.
+	b.Reload()
+	if err := connect("testClient", "testPassword"); err != nil {
+		t.Fatalf("connect failed: %v", err)
+	}
+	expectCalls(5)
+
+	if err := os.WriteFile(urlPath, []byte(authSrv.URL+"/v2\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	b.Reload()
+	if err := connect("testClient", "testPassword"); err != nil {
+		t.Fatalf("connect failed: %v", err)
+	}
+	expectCalls(6)
+}
+
+func TestDenialsAreNotCachedWithoutNegativeTTL(t *testing.T) {
+	var calls atomic.Int32
+	authSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer authSrv.Close()
+
+	cfg := &broker.BrokerConfig{AuthorizeURL: authSrv.URL, AuthCacheTTL: time.Minute}
+	cfg.Load()
+	startBroker(t, cfg)
+
+	for range 2 {
+		opts := mqtt.NewClientOptions().
+			AddBroker("tcp://" + cfg.TCPAddr).
+			SetClientID("cache-test").
+			SetUsername("testClient").
+			SetPassword("wrong").
+			SetProtocolVersion(4).
+			SetConnectTimeout(2 * time.Second)
+
+		tok := mqtt.NewClient(opts).Connect()
+		if !tok.WaitTimeout(5*time.Second) || tok.Error() == nil {
+			t.Fatal("expected connection with a wrong password to fail")
+		}
+	}
+	if got := calls.Load(); got != 2 {
+		t.Fatalf("expected the max-age of denials to be ignored without a negative TTL, got %d requests", got)
+	}
+}
@@ -0,0 +1,84 @@
+package test
+
+import (
+	"mqtt2http/broker"
+	"mqtt2http/lib"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+func TestAuthChainAllowsKnownClientsDuringOutage(t *testing.T) {
+	var down atomic.Bool
+	authSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if down.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		_, password, _ := r.BasicAuth()
+		if password != "testPassword" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer authSrv.Close()
+
+	cfg := &broker.BrokerConfig{
+		AuthorizeURL:      authSrv.URL,
+		Authenticators:    []string{lib.AuthenticatorAnonymous, lib.AuthenticatorHTTP},
+		AuthFailurePolicy: lib.AuthFailKnown,
+		AuthKnownTTL:      time.Hour,
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("invalid config: %v", err)
+	}
+	cfg.Load()
+	startBroker(t, cfg)
+
+	connect := func(clientID string, username string, password string) error {
+		opts := mqtt.NewClientOptions().
+			AddBroker("tcp://" + cfg.TCPAddr).
+			SetClientID(clientID).
+			SetUsername(username).
+			SetPassword(password).
+			SetProtocolVersion(4).
+			SetConnectTimeout(2 * time.Second)
+
+		client := mqtt.NewClient(opts)
+		tok := client.Connect()
+		if !tok.WaitTimeout(5 * time.Second) {
+			t.Fatal("connect timed out")
+		}
+		if tok.Error() == nil {
+			client.Disconnect(250)
+		}
+		return tok.Error()
+	}
+
+	if err := connect("known", "device", "testPassword"); err != nil {
+		t.Fatalf("connect failed: %v", err)
+	}
+
+	down.Store(true)
+
+	if err := connect("known", "device", "testPassword"); err != nil {
+		t.Fatalf("connect of a known client during the outage failed: %v", err)
+	}
+	if err := connect("unknown", "device", "testPassword"); err == nil {
+		t.Fatal("expected connect of an unknown client during the outage to fail")
+	}
+	if err := connect("anonymous", "", ""); err != nil {
+		t.Fatalf("anonymous connect failed: %v", err)
+	}
+
+	down.Store(false)
+
+	if err := connect("known", "device", "wrong"); err == nil {
+		t.Fatal("expected connect with a wrong password to fail")
+	}
+}
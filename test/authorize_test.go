@@ -0,0 +1,91 @@
+package test
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"mqtt2http/broker"
+	"mqtt2http/lib"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+func TestAuthorizeRequestCarriesClientDetails(t *testing.T) {
+	dir := t.TempDir()
+	ca := createCertificate(t, dir, "ca", nil, true)
+	server := createCertificate(t, dir, "server", ca, false)
+	device := createCertificate(t, dir, "device", ca, false)
+
+	requests := make(chan lib.AuthRequest, 1)
+	authSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req lib.AuthRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Errorf("auth: invalid body: %v", err)
+		}
+		if r.Header.Get("X-Forwarded-For") != "127.0.0.1" {
+			t.Errorf("auth: unexpected X-Forwarded-For %q", r.Header.Get("X-Forwarded-For"))
+		}
+		requests <- req
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer authSrv.Close()
+
+	tlsAddr := freePortAddr(t)
+	cfg := &broker.BrokerConfig{
+		AuthorizeURL:    authSrv.URL,
+		AuthorizeFormat: lib.AuthorizeFormatJSON,
+		TLSAddr:         tlsAddr,
+		TLSCertFile:     server.certPath,
+		TLSKeyFile:      server.keyPath,
+		TLSClientCAFile: ca.certPath,
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("invalid config: %v", err)
+	}
+	startBroker(t, cfg)
+	waitForTCP(t, tlsAddr, 5*time.Second)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	pair, err := tls.LoadX509KeyPair(device.certPath, device.keyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	opts := mqtt.NewClientOptions().
+		AddBroker("ssl://" + tlsAddr).
+		SetClientID("details-test").
+		SetUsername("testClient").
+		SetPassword("testPassword").
+		SetCleanSession(true).
+		SetConnectTimeout(2 * time.Second).
+		SetTLSConfig(&tls.Config{RootCAs: roots, Certificates: []tls.Certificate{pair}})
+
+	client := mqtt.NewClient(opts)
+	if tok := client.Connect(); !tok.WaitTimeout(5*time.Second) || tok.Error() != nil {
+		t.Fatalf("connect failed: %v", tok.Error())
+	}
+	t.Cleanup(func() { client.Disconnect(250) })
+
+	sum := sha256.Sum256(device.cert.Raw)
+	select {
+	case req := <-requests:
+		if req.ClientID != "details-test" || req.Username != "testClient" || req.Password != "testPassword" {
+			t.Fatalf("unexpected credentials %+v", req)
+		}
+		if req.Listener != broker.ListenerTLS || req.ProtocolVersion != 4 || !req.CleanStart {
+			t.Fatalf("unexpected connection details %+v", req)
+		}
+		if req.CertSubject != "CN=device" || req.CertFingerprint != hex.EncodeToString(sum[:]) {
+			t.Fatalf("unexpected certificate details %+v", req)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("timed out waiting for authorize request")
+	}
+}
@@ -0,0 +1,103 @@
+package test
+
+import (
+	"fmt"
+	"mqtt2http/broker"
+	"mqtt2http/lib"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/mochi-mqtt/server/v2/packets"
+)
+
+func TestKickAndBanClients(t *testing.T) {
+	authSrv := createAuthSrv(t, "device", "testPassword")
+	defer authSrv.Close()
+
+	bansFile := filepath.Join(t.TempDir(), "bans.json")
+	cfg := &broker.BrokerConfig{AuthorizeURL: authSrv.URL, APIPassword: "secret", BansFilePath: bansFile}
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("invalid config: %v", err)
+	}
+	cfg.Load()
+	startBroker(t, cfg)
+	api := fmt.Sprintf("http://%s", cfg.HTTPAddr)
+
+	lost := make(chan string, 2)
+	connectSession(t, cfg.TCPAddr, "device-1", "device", lost)
+	code, content := apiRequest(t, http.MethodDelete, api+"/clients/device-1?code=0x98&reason=maintenance", "secret", nil)
+	if code != http.StatusNoContent {
+		t.Fatalf("kick failed with %d: %s", code, content)
+	}
+	select {
+	case <-lost:
+	case <-time.After(5 * time.Second):
+		t.Fatal("kicked client was not disconnected")
+	}
+	if code, _ := apiRequest(t, http.MethodDelete, api+"/clients/device-1", "secret", nil); code != http.StatusNotFound {
+		t.Fatalf("expected 404 for a disconnected client, got %d", code)
+	}
+
+	connectSession(t, cfg.TCPAddr, "device-2", "device", lost)
+	code, content = apiRequest(t, http.MethodPost, api+"/bans", "secret", strings.NewReader(`{"kind":"username","value":"device","duration":"1h","reason":"incident"}`))
+	if code != http.StatusCreated {
+		t.Fatalf("ban failed with %d: %s", code, content)
+	}
+	select {
+	case <-lost:
+	case <-time.After(5 * time.Second):
+		t.Fatal("banned client was not disconnected")
+	}
+
+	connack := connectV5(t, cfg.TCPAddr, "device-3", "device", "testPassword")
+	if connack.ReasonCode != packets.ErrBanned.Code || connack.Properties.ReasonString != "incident" {
+		t.Fatalf("expected banned with reason, got 0x%x %q", connack.ReasonCode, connack.Properties.ReasonString)
+	}
+
+	saved, err := lib.NewBanList(bansFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bans := saved.List(); len(bans) != 1 || bans[0].Value != "device" || bans[0].ExpiresAt == nil {
+		t.Fatalf("unexpected saved bans %+v", bans)
+	}
+
+	code, content = apiRequest(t, http.MethodDelete, api+"/bans?kind=username&value=device", "secret", nil)
+	if code != http.StatusNoContent {
+		t.Fatalf("lifting the ban failed with %d: %s", code, content)
+	}
+	if connack := connectV5(t, cfg.TCPAddr, "device-3", "device", "testPassword"); connack.ReasonCode != packets.CodeSuccess.Code {
+		t.Fatalf("connect after lifting the ban failed with 0x%x", connack.ReasonCode)
+	}
+
+	code, content = apiRequest(t, http.MethodPost, api+"/bans", "secret", strings.NewReader(`{"kind":"ip","value":"127.0.0.0/8"}`))
+	if code != http.StatusCreated {
+		t.Fatalf("IP ban failed with %d: %s", code, content)
+	}
+	if connack := connectV5(t, cfg.TCPAddr, "device-4", "device", "testPassword"); connack.ReasonCode != packets.ErrBanned.Code {
+		t.Fatalf("expected banned, got 0x%x", connack.ReasonCode)
+	}
+	opts := mqtt.NewClientOptions().AddBroker("tcp://" + cfg.TCPAddr).SetClientID("device-5").SetUsername("device").SetPassword("testPassword")
+	tok := mqtt.NewClient(opts).Connect()
+	if !tok.WaitTimeout(5*time.Second) || tok.Error() == nil || !strings.Contains(tok.Error().Error(), "not Authorized") {
+		t.Fatalf("expected MQTT 3 client to be refused as not authorized, got %v", tok.Error())
+	}
+
+	code, _ = apiRequest(t, http.MethodPost, api+"/bans", "secret", strings.NewReader(`{"kind":"ip","value":"not-an-ip"}`))
+	if code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for an invalid IP, got %d", code)
+	}
+}
+
+func TestUnwritableBansFileFailsValidation(t *testing.T) {
+	// A missing file holds no bans, but it could not be created.
+	bansFile := filepath.Join(t.TempDir(), "missing", "bans.json")
+	cfg := &broker.BrokerConfig{AuthorizeURL: "http://127.0.0.1/auth", BansFilePath: bansFile}
+	if err := cfg.Validate(); err == nil || !strings.Contains(err.Error(), "bans file cannot be saved") {
+		t.Fatalf("expected an unwritable bans file to fail validation, got %v", err)
+	}
+}
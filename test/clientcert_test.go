@@ -0,0 +1,137 @@
+package test
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"mqtt2http/broker"
+	"mqtt2http/lib"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+func TestClientCertificateAuthentication(t *testing.T) {
+	dir := t.TempDir()
+	ca := createCertificate(t, dir, "ca", nil, true)
+	server := createCertificate(t, dir, "server", ca, false)
+	sensor := createCertificate(t, dir, "sensor", ca, false)
+	stolen := createCertificate(t, dir, "stolen", ca, false)
+
+	forwarded := make(chan http.Header, 2)
+	pubSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwarded <- r.Header
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer pubSrv.Close()
+
+	sum := sha256.Sum256(stolen.cert.Raw)
+	revokedPath := filepath.Join(dir, "revoked")
+	if err := os.WriteFile(revokedPath, []byte("# lost on 2024-05-01\n"+hex.EncodeToString(sum[:])+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	aclPath := filepath.Join(dir, "acl.yaml")
+	err := os.WriteFile(aclPath, []byte(`
+default: deny
+rules:
+  - permission: allow
+    topics: ['devices/%C/#']
+`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tlsAddr := freePortAddr(t)
+	wsAddr := freePortAddr(t)
+	cfg := &broker.BrokerConfig{
+		TLSAddr:         tlsAddr,
+		WSAddr:          wsAddr,
+		WSPath:          "/mqtt",
+		WSTLS:           true,
+		TLSCertFile:     server.certPath,
+		TLSKeyFile:      server.keyPath,
+		TLSClientCAFile: ca.certPath,
+		Authenticators:  []string{lib.AuthenticatorClientCert},
+		CertUsername:    "device-{cn}",
+		CertRevokedFile: revokedPath,
+		ACLFilePath:     aclPath,
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("invalid config: %v", err)
+	}
+	cfg.Load()
+	cfg.Routes = []lib.Route{{
+		Name:      "devices",
+		Pattern:   "^devices/",
+		URL:       pubSrv.URL,
+		Usernames: []string{"device-.*"},
+		Headers:   map[string]string{"X-Device": "{username}", "X-Fingerprint": "{cert_fingerprint}"},
+	}}
+	startBroker(t, cfg)
+	waitForTCP(t, tlsAddr, 5*time.Second)
+	waitForTCP(t, wsAddr, 5*time.Second)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	connect := func(device *testCertificate, listener string, brokerURL string) (mqtt.Client, error) {
+		pair, err := tls.LoadX509KeyPair(device.certPath, device.keyPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		opts := mqtt.NewClientOptions().
+			AddBroker(brokerURL).
+			SetClientID("cert-" + device.cert.Subject.CommonName + "-" + listener).
+			SetProtocolVersion(4).
+			SetConnectTimeout(2 * time.Second).
+			SetTLSConfig(&tls.Config{RootCAs: roots, Certificates: []tls.Certificate{pair}})
+
+		client := mqtt.NewClient(opts)
+		tok := client.Connect()
+		if !tok.WaitTimeout(5 * time.Second) {
+			t.Fatal("connect timed out")
+		}
+		if tok.Error() == nil {
+			t.Cleanup(func() { client.Disconnect(250) })
+		}
+		return client, tok.Error()
+	}
+
+	sum = sha256.Sum256(sensor.cert.Raw)
+	for listener, brokerURL := range map[string]string{"tls": "ssl://" + tlsAddr, "wss": "wss://" + wsAddr + "/mqtt"} {
+		if _, err := connect(stolen, listener, brokerURL); err == nil {
+			t.Fatalf("expected connect to %s with a revoked certificate to fail", brokerURL)
+		}
+
+		client, err := connect(sensor, listener, brokerURL)
+		if err != nil {
+			t.Fatalf("connect to %s with a client certificate failed: %v", brokerURL, err)
+		}
+
+		for _, topic := range []string{"devices/stolen/state", "devices/sensor/state"} {
+			if tok := client.Publish(topic, 0, false, []byte("on")); !tok.WaitTimeout(5*time.Second) || tok.Error() != nil {
+				t.Fatalf("publish failed: %v", tok.Error())
+			}
+		}
+
+		select {
+		case header := <-forwarded:
+			if header.Get("X-Device") != "device-sensor" || header.Get("X-Fingerprint") != hex.EncodeToString(sum[:]) {
+				t.Fatalf("unexpected identity headers over %s: %v", brokerURL, header)
+			}
+		case <-time.After(3 * time.Second):
+			t.Fatalf("timed out waiting for forwarded request over %s", brokerURL)
+		}
+		select {
+		case header := <-forwarded:
+			t.Fatalf("message denied by the ACL was forwarded with %v", header)
+		case <-time.After(200 * time.Millisecond):
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package test
+
+import (
+	"encoding/json"
+	"fmt"
+	"mqtt2http/broker"
+	"mqtt2http/lib"
+	"net/http"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/mochi-mqtt/server/v2/packets"
+)
+
+func TestClientDetails(t *testing.T) {
+	authSrv := createAuthSrv(t, "device", "testPassword")
+	defer authSrv.Close()
+	receiveChan := make(chan []byte, 1)
+	pubSrv := createPubSrv(t, receiveChan)
+	defer pubSrv.Close()
+
+	cfg := &broker.BrokerConfig{AuthorizeURL: authSrv.URL, PublishURL: pubSrv.URL, ContentType: "application/json", APIPassword: "secret"}
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("invalid config: %v", err)
+	}
+	cfg.Load()
+	startBroker(t, cfg)
+
+	opts := mqtt.NewClientOptions().
+		AddBroker("tcp://"+cfg.TCPAddr).
+		SetClientID("sensor-1").
+		SetUsername("device").
+		SetPassword("testPassword").
+		SetProtocolVersion(4).
+		SetCleanSession(false).
+		SetKeepAlive(45*time.Second).
+		SetWill("devices/sensor-1/status", "offline", 1, true)
+	client := mqtt.NewClient(opts)
+	if tok := client.Connect(); !tok.WaitTimeout(5*time.Second) || tok.Error() != nil {
+		t.Fatalf("connect failed: %v", tok.Error())
+	}
+	defer client.Disconnect(250)
+
+	if tok := client.Publish("devices/sensor-1/data", 0, false, "hello"); !tok.WaitTimeout(5*time.Second) || tok.Error() != nil {
+		t.Fatalf("publish failed: %v", tok.Error())
+	}
+	select {
+	case <-receiveChan:
+	case <-time.After(3 * time.Second):
+		t.Fatal("timed out waiting for forwarded request")
+	}
+
+	code, content := apiRequest(t, http.MethodGet, fmt.Sprintf("http://%s/clients/sensor-1", cfg.HTTPAddr), "secret", nil)
+	if code != http.StatusOK {
+		t.Fatalf("client details failed with %d: %s", code, content)
+	}
+	var details lib.ClientDetails
+	if err := json.Unmarshal(content, &details); err != nil {
+		t.Fatal(err)
+	}
+	if details.ID != "sensor-1" || details.Client == nil || details.Username != "device" || details.Publications["devices/sensor-1/data"] != 1 {
+		t.Fatalf("unexpected record in %s", content)
+	}
+	if !details.Connected || details.ProtocolVersion != 4 || details.Keepalive != 45 || details.CleanStart {
+		t.Fatalf("unexpected session state in %s", content)
+	}
+	if details.Will == nil || details.Will.Topic != "devices/sensor-1/status" || string(details.Will.Payload) != "offline" || !details.Will.Retain {
+		t.Fatalf("unexpected will in %s", content)
+	}
+	if details.BytesReceived == 0 || details.BytesSent == 0 {
+		t.Fatalf("expected traffic to be counted in %s", content)
+	}
+
+	code, _ = apiRequest(t, http.MethodGet, fmt.Sprintf("http://%s/clients/unknown", cfg.HTTPAddr), "secret", nil)
+	if code != http.StatusNotFound {
+		t.Fatalf("expected 404 for an unknown client, got %d", code)
+	}
+}
+
+func TestClientDetailsPendingMessages(t *testing.T) {
+	authSrv := createAuthSrv(t, "device", "testPassword")
+	defer authSrv.Close()
+
+	cfg := &broker.BrokerConfig{AuthorizeURL: authSrv.URL, APIPassword: "secret"}
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("invalid config: %v", err)
+	}
+	cfg.Load()
+	startBroker(t, cfg)
+
+	// With a receive maximum of 1, the messages after the first one wait
+	// until it is acknowledged.
+	conn, reader, _ := dialV5WithProperties(t, cfg.TCPAddr, "slow", "device", "testPassword", packets.Properties{ReceiveMaximum: 1})
+	sendV5(t, conn, packets.Packet{
+		FixedHeader: packets.FixedHeader{Type: packets.Subscribe, Qos: 1},
+		PacketID:    1,
+		Filters:     packets.Subscriptions{{Filter: "jobs/#", Qos: 1}},
+	})
+	if suback := readPacketV5(t, reader); suback.FixedHeader.Type != packets.Suback {
+		t.Fatalf("expected SUBACK, got packet type %d", suback.FixedHeader.Type)
+	}
+
+	opts := mqtt.NewClientOptions().
+		AddBroker("tcp://" + cfg.TCPAddr).
+		SetClientID("producer").
+		SetUsername("device").
+		SetPassword("testPassword").
+		SetProtocolVersion(4)
+	client := mqtt.NewClient(opts)
+	if tok := client.Connect(); !tok.WaitTimeout(5*time.Second) || tok.Error() != nil {
+		t.Fatalf("connect failed: %v", tok.Error())
+	}
+	defer client.Disconnect(250)
+	for i := range 3 {
+		if tok := client.Publish(fmt.Sprintf("jobs/%d", i), 1, false, "work"); !tok.WaitTimeout(5*time.Second) || tok.Error() != nil {
+			t.Fatalf("publish failed: %v", tok.Error())
+		}
+	}
+	if publish := readPacketV5(t, reader); publish.FixedHeader.Type != packets.Publish {
+		t.Fatalf("expected PUBLISH, got packet type %d", publish.FixedHeader.Type)
+	}
+
+	// The broker acknowledges a message before delivering it.
+	deadline := time.Now().Add(3 * time.Second)
+	for {
+		code, content := apiRequest(t, http.MethodGet, fmt.Sprintf("http://%s/clients/slow", cfg.HTTPAddr), "secret", nil)
+		var details lib.ClientDetails
+		if err := json.Unmarshal(content, &details); code != http.StatusOK || err != nil {
+			t.Fatalf("client details failed with %d: %s", code, content)
+		}
+		if details.Inflight == 3 && details.Pending == 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected 3 inflight and 2 pending messages in %s", content)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
@@ -0,0 +1,109 @@
+package test
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"mqtt2http/broker"
+	"mqtt2http/lib"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// queryClients calls /clients and returns the client IDs and the cursor of
+// the next page.
+func queryClients(t *testing.T, addr string, query string) ([]string, string) {
+	t.Helper()
+
+	code, content, header := apiGet(t, fmt.Sprintf("http://%s/clients?%s", addr, query))
+	if code != http.StatusOK {
+		t.Fatalf("query %q failed with %d: %s", query, code, content)
+	}
+	var clients []lib.Client
+	if err := json.Unmarshal(content, &clients); err != nil {
+		t.Fatal(err)
+	}
+	ids := []string{}
+	for _, client := range clients {
+		ids = append(ids, client.ID)
+	}
+	return ids, header.Get("X-Next-Cursor")
+}
+
+func apiGet(t *testing.T, url string) (int, []byte, http.Header) {
+	t.Helper()
+
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.SetBasicAuth("test", "secret")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	defer resp.Body.Close()
+	content, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, content, resp.Header
+}
+
+func TestClientsQuery(t *testing.T) {
+	authSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer authSrv.Close()
+
+	cfg := &broker.BrokerConfig{AuthorizeURL: authSrv.URL, APIPassword: "secret"}
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("invalid config: %v", err)
+	}
+	cfg.Load()
+	startBroker(t, cfg)
+
+	for i := 1; i <= 3; i++ {
+		connectSession(t, cfg.TCPAddr, fmt.Sprintf("sensor-%d", i), "device", nil)
+	}
+	gateway := connectSession(t, cfg.TCPAddr, "gateway-1", "gateway", nil)
+	if tok := gateway.Subscribe("alerts/#", 0, nil); !tok.WaitTimeout(5*time.Second) || tok.Error() != nil {
+		t.Fatalf("subscribe failed: %v", tok.Error())
+	}
+
+	if ids, _ := queryClients(t, cfg.HTTPAddr, "username=device&sort=-id"); strings.Join(ids, ",") != "sensor-3,sensor-2,sensor-1" {
+		t.Fatalf("unexpected clients of the username %v", ids)
+	}
+	if ids, _ := queryClients(t, cfg.HTTPAddr, "subscription=alerts/%23"); strings.Join(ids, ",") != "gateway-1" {
+		t.Fatalf("unexpected subscribed clients %v", ids)
+	}
+	if ids, _ := queryClients(t, cfg.HTTPAddr, "inactive_since=1h"); len(ids) != 0 {
+		t.Fatalf("expected no inactive clients, got %v", ids)
+	}
+
+	ids, cursor := queryClients(t, cfg.HTTPAddr, "client_id_prefix=sensor&sort=connected_at&limit=2")
+	if strings.Join(ids, ",") != "sensor-1,sensor-2" || cursor == "" {
+		t.Fatalf("unexpected first page %v with cursor %q", ids, cursor)
+	}
+	ids, cursor = queryClients(t, cfg.HTTPAddr, "client_id_prefix=sensor&sort=connected_at&limit=2&cursor="+cursor)
+	if strings.Join(ids, ",") != "sensor-3" || cursor != "" {
+		t.Fatalf("unexpected last page %v with cursor %q", ids, cursor)
+	}
+
+	code, content, _ := apiGet(t, fmt.Sprintf("http://%s/clients?format=ndjson", cfg.HTTPAddr))
+	if code != http.StatusOK || strings.Count(string(content), "\n") != 4 {
+		t.Fatalf("unexpected NDJSON with %d: %s", code, content)
+	}
+	code, content, _ = apiGet(t, fmt.Sprintf("http://%s/clients?format=csv&listener=tcp&sort=id", cfg.HTTPAddr))
+	lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+	if code != http.StatusOK || len(lines) != 5 || !strings.HasPrefix(lines[0], "id,username,") || !strings.HasPrefix(lines[1], "gateway-1,gateway,tcp,") {
+		t.Fatalf("unexpected CSV with %d: %s", code, content)
+	}
+
+	if code, _, _ := apiGet(t, fmt.Sprintf("http://%s/clients?sort=bogus", cfg.HTTPAddr)); code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for an unknown sort order, got %d", code)
+	}
+}
@@ -1,13 +1,19 @@
 package test
 
 import (
+	"bufio"
+	"bytes"
 	"context"
 	"io"
+	"mqtt2http/broker"
 	"net"
 	"net/http"
 	"net/http/httptest"
 	"testing"
 	"time"
+
+	"github.com/mochi-mqtt/server/v2/packets"
+	"github.com/prometheus/client_golang/prometheus"
 )
 
 // freePortAddr returns "127.0.0.1:PORT" by binding to :0 and closing.
@@ -86,3 +92,137 @@ func createPubSrv(t *testing.T, receiveChan chan []byte) *httptest.Server {
 	}))
 	return pubSrv
 }
+
+// startBroker starts a broker on free ports and waits for the MQTT listener.
+func startBroker(t *testing.T, cfg *broker.BrokerConfig) *broker.Broker {
+	t.Helper()
+
+	if cfg.TCPAddr == "" {
+		cfg.TCPAddr = freePortAddr(t)
+	}
+	if cfg.HTTPAddr == "" {
+		cfg.HTTPAddr = freePortAddr(t)
+	}
+	if cfg.MetricsHTTPAddr == "" {
+		cfg.MetricsHTTPAddr = freePortAddr(t)
+	}
+
+	b := broker.NewBroker(cfg)
+	t.Cleanup(func() { b.Close() })
+
+	if err := b.Start(prometheus.NewRegistry()); err != nil {
+		t.Fatalf("broker start failed: %v", err)
+	}
+
+	waitForTCP(t, cfg.TCPAddr, 5*time.Second)
+	waitForTCP(t, cfg.HTTPAddr, 5*time.Second)
+	return b
+}
+
+// apiRequest calls the broker REST API with the given password.
+func apiRequest(t *testing.T, method string, url string, password string, body io.Reader) (int, []byte) {
+	t.Helper()
+
+	req, err := http.NewRequest(method, url, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.SetBasicAuth("test", password)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	content, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("response read failed: %v", err)
+	}
+	return resp.StatusCode, content
+}
+
+// connectV5 sends an MQTT 5 CONNECT and returns the CONNACK, since the paho
+// client only speaks MQTT 3.
+func connectV5(t *testing.T, addr string, clientID string, username string, password string) packets.Packet {
+	t.Helper()
+
+	conn, _, connack := dialV5(t, addr, clientID, username, password)
+	conn.Close()
+	return connack
+}
+
+// dialV5 connects with MQTT 5 and returns the connection, its reader and
+// the CONNACK. The connection is closed at the end of the test.
+func dialV5(t *testing.T, addr string, clientID string, username string, password string) (net.Conn, *bufio.Reader, packets.Packet) {
+	t.Helper()
+
+	return dialV5WithProperties(t, addr, clientID, username, password, packets.Properties{})
+}
+
+// dialV5WithProperties connects with MQTT 5 like dialV5, sending the
+// properties in the CONNECT.
+func dialV5WithProperties(t *testing.T, addr string, clientID string, username string, password string, props packets.Properties) (net.Conn, *bufio.Reader, packets.Packet) {
+	t.Helper()
+
+	conn, err := net.DialTimeout("tcp", addr, 2*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	connect := packets.Packet{
+		FixedHeader:     packets.FixedHeader{Type: packets.Connect},
+		ProtocolVersion: 5,
+		Properties:      props,
+		Connect: packets.ConnectParams{
+			ProtocolName:     []byte("MQTT"),
+			Clean:            true,
+			Keepalive:        30,
+			ClientIdentifier: clientID,
+			UsernameFlag:     username != "",
+			Username:         []byte(username),
+			PasswordFlag:     password != "",
+			Password:         []byte(password),
+		},
+	}
+	buf := new(bytes.Buffer)
+	if err := connect.ConnectEncode(buf); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Write(buf.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+
+	reader := bufio.NewReader(conn)
+	connack := readPacketV5(t, reader)
+	if err := connack.ConnackDecode(connack.Payload); err != nil {
+		t.Fatal(err)
+	}
+	return conn, reader, connack
+}
+
+// readPacketV5 reads the fixed header of an MQTT 5 packet and leaves its
+// body in Payload, to be decoded by the caller.
+func readPacketV5(t *testing.T, reader *bufio.Reader) packets.Packet {
+	t.Helper()
+
+	header, err := reader.ReadByte()
+	if err != nil {
+		t.Fatalf("read packet failed: %v", err)
+	}
+	pk := packets.Packet{ProtocolVersion: 5}
+	if err := pk.FixedHeader.Decode(header); err != nil {
+		t.Fatal(err)
+	}
+	length, _, err := packets.DecodeLength(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pk.Payload = make([]byte, length)
+	if _, err := io.ReadFull(reader, pk.Payload); err != nil {
+		t.Fatal(err)
+	}
+	return pk
+}
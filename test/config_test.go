@@ -0,0 +1,74 @@
+package test
+
+import (
+	"fmt"
+	"mqtt2http/broker"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRoutesAreInterpolatedFromEnvAndFiles(t *testing.T) {
+	dir := t.TempDir()
+
+	tokenPath := filepath.Join(dir, "token")
+	if err := os.WriteFile(tokenPath, []byte("s3cret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("ROUTE_HOST", "example.com")
+	t.Setenv("ROUTE_TOKEN_FILE", tokenPath)
+
+	routesPath := filepath.Join(dir, "routes.yaml")
+	routes := `
+- name: telemetry
+  pattern: '^sensors/'
+  url: https://${ROUTE_HOST}/{topic}
+  headers:
+    Authorization: Bearer ${ROUTE_TOKEN}
+`
+	if err := os.WriteFile(routesPath, []byte(routes), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := &broker.BrokerConfig{RoutesFilePath: routesPath}
+	cfg.Load()
+
+	if len(cfg.Routes) != 1 {
+		t.Fatalf("expected one route, got %d", len(cfg.Routes))
+	}
+	if cfg.Routes[0].URL != "https://example.com/{topic}" {
+		t.Fatalf("unexpected route URL %q", cfg.Routes[0].URL)
+	}
+	if cfg.Routes[0].Headers["Authorization"] != "Bearer s3cret" {
+		t.Fatalf("unexpected route header %q", cfg.Routes[0].Headers["Authorization"])
+	}
+}
+
+func TestAPIPasswordFileIsReloaded(t *testing.T) {
+	passwordPath := filepath.Join(t.TempDir(), "password")
+	if err := os.WriteFile(passwordPath, []byte("first\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := &broker.BrokerConfig{APIPassword: "from-env", APIPasswordFile: passwordPath}
+	cfg.Load()
+	b := startBroker(t, cfg)
+
+	url := fmt.Sprintf("http://%s/clients", cfg.HTTPAddr)
+	if code, _ := apiRequest(t, http.MethodGet, url, "first", nil); code != http.StatusOK {
+		t.Fatalf("expected password from file to be accepted, got %d", code)
+	}
+
+	if err := os.WriteFile(passwordPath, []byte("second\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	b.Reload()
+
+	if code, _ := apiRequest(t, http.MethodGet, url, "first", nil); code != http.StatusForbidden {
+		t.Fatalf("expected old password to be rejected, got %d", code)
+	}
+	if code, _ := apiRequest(t, http.MethodGet, url, "second", nil); code != http.StatusOK {
+		t.Fatalf("expected new password to be accepted, got %d", code)
+	}
+}
@@ -0,0 +1,59 @@
+package test
+
+import (
+	"mqtt2http/broker"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/mochi-mqtt/server/v2/packets"
+)
+
+func TestConnackReasonCodes(t *testing.T) {
+	authSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		username, _, _ := r.BasicAuth()
+		switch username {
+		case "unknown":
+			w.WriteHeader(http.StatusUnauthorized)
+		case "suspended":
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(`{"reason":"subscription expired"}`))
+		case "outage":
+			w.WriteHeader(http.StatusServiceUnavailable)
+		case "misrouted":
+			w.WriteHeader(http.StatusNotFound)
+		case "throttled":
+			w.WriteHeader(http.StatusTooManyRequests)
+		default:
+			w.WriteHeader(http.StatusOK)
+		}
+	}))
+	defer authSrv.Close()
+
+	cfg := &broker.BrokerConfig{AuthorizeURL: authSrv.URL}
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("invalid config: %v", err)
+	}
+	cfg.Load()
+	startBroker(t, cfg)
+
+	tests := []struct {
+		username string
+		code     packets.Code
+		reason   string
+	}{
+		{"device", packets.CodeSuccess, ""},
+		{"unknown", packets.ErrBadUsernameOrPassword, packets.ErrBadUsernameOrPassword.Reason},
+		{"suspended", packets.ErrNotAuthorized, "subscription expired"},
+		{"outage", packets.ErrServerUnavailable, packets.ErrServerUnavailable.Reason},
+		{"misrouted", packets.ErrServerUnavailable, packets.ErrServerUnavailable.Reason},
+		{"throttled", packets.ErrServerUnavailable, packets.ErrServerUnavailable.Reason},
+	}
+	for _, test := range tests {
+		connack := connectV5(t, cfg.TCPAddr, "client-"+test.username, test.username, "testPassword")
+		if connack.ReasonCode != test.code.Code || connack.Properties.ReasonString != test.reason {
+			t.Errorf("%s: expected 0x%x %q, got 0x%x %q", test.username, test.code.Code, test.reason, connack.ReasonCode, connack.Properties.ReasonString)
+		}
+	}
+}
@@ -0,0 +1,170 @@
+package test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"mqtt2http/broker"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// signToken returns an ES256 JWT with the claims.
+func signToken(t *testing.T, key *ecdsa.PrivateKey, kid string, claims map[string]any) string {
+	t.Helper()
+
+	encode := func(v any) string {
+		data, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return base64.RawURLEncoding.EncodeToString(data)
+	}
+
+	signed := encode(map[string]string{"alg": "ES256", "typ": "JWT", "kid": kid}) + "." + encode(claims)
+	digest := sha256.Sum256([]byte(signed))
+	r, s, err := ecdsa.Sign(rand.Reader, key, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	signature := make([]byte, 64)
+	r.FillBytes(signature[:32])
+	s.FillBytes(signature[32:])
+
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+// writeJWKS writes the public key as a JSON Web Key Set.
+func writeJWKS(t *testing.T, path string, key *ecdsa.PrivateKey, kid string) {
+	t.Helper()
+
+	coordinate := func(n interface{ FillBytes([]byte) []byte }) string {
+		return base64.RawURLEncoding.EncodeToString(n.FillBytes(make([]byte, 32)))
+	}
+	set := map[string]any{"keys": []map[string]string{{
+		"kty": "EC",
+		"crv": "P-256",
+		"kid": kid,
+		"use": "sig",
+		"x":   coordinate(key.X),
+		"y":   coordinate(key.Y),
+	}}}
+	data, err := json.Marshal(set)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestJWTPasswordsAreVerifiedLocally(t *testing.T) {
+	authSrv := createAuthSrv(t, "legacy", "testPassword")
+	defer authSrv.Close()
+
+	oldKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	jwksPath := filepath.Join(t.TempDir(), "jwks.json")
+	writeJWKS(t, jwksPath, oldKey, "old")
+
+	cfg := &broker.BrokerConfig{
+		AuthorizeURL:     authSrv.URL,
+		JWKSFile:         jwksPath,
+		JWTIssuer:        "https://issuer.example.com",
+		JWTAudience:      "mqtt2http",
+		JWTUsernameClaim: "device",
+		JWTPermissions:   "mqtt",
+		APIPassword:      "secret",
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("invalid config: %v", err)
+	}
+	cfg.Load()
+	b := startBroker(t, cfg)
+
+	connect := func(clientID string, username string, password string) (mqtt.Client, error) {
+		opts := mqtt.NewClientOptions().
+			AddBroker("tcp://" + cfg.TCPAddr).
+			SetClientID(clientID).
+			SetUsername(username).
+			SetPassword(password).
+			SetProtocolVersion(4).
+			SetConnectTimeout(2 * time.Second)
+
+		client := mqtt.NewClient(opts)
+		tok := client.Connect()
+		if !tok.WaitTimeout(5 * time.Second) {
+			t.Fatal("connect timed out")
+		}
+		if tok.Error() == nil {
+			t.Cleanup(func() { client.Disconnect(250) })
+		}
+		return client, tok.Error()
+	}
+	claims := func(changes map[string]any) map[string]any {
+		claims := map[string]any{
+			"iss":    "https://issuer.example.com",
+			"aud":    []string{"mqtt2http"},
+			"exp":    time.Now().Add(time.Hour).Unix(),
+			"device": "sensor-1",
+			"mqtt":   map[string]any{"publish": []string{"devices/%u/#"}},
+		}
+		for name, value := range changes {
+			claims[name] = value
+		}
+		return claims
+	}
+
+	if _, err := connect("jwt-valid", "ignored", signToken(t, oldKey, "old", claims(nil))); err != nil {
+		t.Fatalf("connect with a valid token failed: %v", err)
+	}
+
+	for name, token := range map[string]string{
+		"expired":       signToken(t, oldKey, "old", claims(map[string]any{"exp": time.Now().Add(-time.Hour).Unix()})),
+		"wrong issuer":  signToken(t, oldKey, "old", claims(map[string]any{"iss": "https://other.example.com"})),
+		"wrong aud":     signToken(t, oldKey, "old", claims(map[string]any{"aud": "other"})),
+		"unknown key":   signToken(t, newKey, "new", claims(nil)),
+		"wrong key":     signToken(t, newKey, "old", claims(nil)),
+		"not yet valid": signToken(t, oldKey, "old", claims(map[string]any{"nbf": time.Now().Add(time.Hour).Unix()})),
+	} {
+		if _, err := connect("jwt-invalid", "ignored", token); err == nil {
+			t.Fatalf("expected connect with %s token to fail", name)
+		}
+	}
+
+	if _, err := connect("jwt-legacy", "legacy", "testPassword"); err != nil {
+		t.Fatalf("connect through the authorize endpoint failed: %v", err)
+	}
+
+	_, content := apiRequest(t, http.MethodGet, fmt.Sprintf("http://%s/clients", cfg.HTTPAddr), "secret", nil)
+	if !strings.Contains(string(content), `"username":"sensor-1"`) || !strings.Contains(string(content), `"publish":["devices/%u/#"]`) {
+		t.Fatalf("identity from the token missing from the clients endpoint, got %s", content)
+	}
+
+	writeJWKS(t, jwksPath, newKey, "new")
+	b.Reload()
+
+	if _, err := connect("jwt-rotated", "ignored", signToken(t, newKey, "new", claims(nil))); err != nil {
+		t.Fatalf("connect with a token of the rotated key failed: %v", err)
+	}
+	if _, err := connect("jwt-old", "ignored", signToken(t, oldKey, "old", claims(nil))); err == nil {
+		t.Fatal("expected connect with a token of the removed key to fail")
+	}
+}
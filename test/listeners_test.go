@@ -0,0 +1,129 @@
+package test
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log/slog"
+	"mqtt2http/broker"
+	"mqtt2http/lib"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+func TestRoutesAreRestrictedToListeners(t *testing.T) {
+	received := make(chan []byte, 2)
+
+	clientUsername := "testClient"
+	clientPassword := "testPassword"
+
+	authSrv := createAuthSrv(t, clientUsername, clientPassword)
+	defer authSrv.Close()
+
+	pubSrv := createPubSrv(t, received)
+	defer pubSrv.Close()
+
+	dir := t.TempDir()
+	socketPath := filepath.Join(dir, "mqtt.sock")
+	tcpAddr := freePortAddr(t)
+
+	listenersPath := filepath.Join(dir, "listeners.yaml")
+	listeners := fmt.Sprintf(`
+- name: devices
+  type: tcp
+  address: %s
+- name: sidecar
+  type: unix
+  address: %s
+`, tcpAddr, socketPath)
+	if err := os.WriteFile(listenersPath, []byte(listeners), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := &broker.BrokerConfig{
+		TCPAddr:           tcpAddr,
+		AuthorizeURL:      authSrv.URL,
+		ContentType:       "application/json",
+		APIPassword:       "secret",
+		ListenersFilePath: listenersPath,
+	}
+	cfg.Load()
+	cfg.Routes = []lib.Route{
+		{Name: "internal", Pattern: ".*", URL: pubSrv.URL, Listeners: []string{"sidecar"}},
+	}
+	startBroker(t, cfg)
+
+	connect := func(broker string, clientID string) mqtt.Client {
+		opts := mqtt.NewClientOptions().
+			AddBroker(broker).
+			SetClientID(clientID).
+			SetUsername(clientUsername).
+			SetPassword(clientPassword).
+			SetConnectTimeout(2 * time.Second)
+
+		client := mqtt.NewClient(opts)
+		if tok := client.Connect(); !tok.WaitTimeout(5*time.Second) || tok.Error() != nil {
+			t.Fatalf("connect to %s failed: %v", broker, tok.Error())
+		}
+		t.Cleanup(func() { client.Disconnect(250) })
+		return client
+	}
+
+	device := connect("tcp://"+tcpAddr, "device")
+	sidecar := connect("unix://"+socketPath, "sidecar")
+
+	if tok := device.Publish("state", 0, false, []byte("from-device")); !tok.WaitTimeout(5*time.Second) || tok.Error() != nil {
+		t.Fatalf("publish failed: %v", tok.Error())
+	}
+	if tok := sidecar.Publish("state", 0, false, []byte("from-sidecar")); !tok.WaitTimeout(5*time.Second) || tok.Error() != nil {
+		t.Fatalf("publish failed: %v", tok.Error())
+	}
+
+	select {
+	case got := <-received:
+		if string(got) != "from-sidecar" {
+			t.Fatalf("unexpected forwarded body %s", got)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("timed out waiting for forwarded request")
+	}
+
+	url := fmt.Sprintf("http://%s/clients", cfg.HTTPAddr)
+	_, content := apiRequest(t, http.MethodGet, url, "secret", nil)
+	if !strings.Contains(string(content), `"listener":"sidecar"`) || !strings.Contains(string(content), `"listener":"devices"`) {
+		t.Fatalf("listener names missing from the clients endpoint, got %s", content)
+	}
+}
+
+func TestStreamListeners(t *testing.T) {
+	if protocol := lib.NewStreamListener("secure", "tcp", "127.0.0.1:0", &tls.Config{}).Protocol(); protocol != "tls" {
+		t.Fatalf("expected the tls protocol, got %s", protocol)
+	}
+	if protocol := lib.NewStreamListener("plain", "tcp", "127.0.0.1:0", nil).Protocol(); protocol != "tcp" {
+		t.Fatalf("expected the tcp protocol, got %s", protocol)
+	}
+
+	// A socket left by a killed broker is replaced, and removed on close.
+	socketPath := filepath.Join(t.TempDir(), "mqtt.sock")
+	stale, err := net.Listen("unix", socketPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	listener := lib.NewStreamListener("sidecar", "unix", socketPath, nil)
+	if err := listener.Init(slog.Default()); err != nil {
+		t.Fatalf("listening on a stale socket failed: %v", err)
+	}
+	listener.Close(func(string) {})
+	if _, err := os.Stat(socketPath); !os.IsNotExist(err) {
+		t.Fatalf("expected the socket to be removed on close, got %v", err)
+	}
+}
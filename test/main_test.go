@@ -100,7 +100,7 @@ func TestPublishIsForwardedToHTTP(t *testing.T) {
 	if err != nil {
 		t.Fatalf("response read failed: %v", err)
 	}
-	if !strings.Contains(string(content), "\"id\":\"it-test\",\"username\":\"testClient\",\"subscriptions\":[\"topic/test\"],\"publications\":{\"devices/42/state\":1}") {
+	if !strings.Contains(string(content), "\"id\":\"it-test\",\"username\":\"testClient\",\"subscriptions\":[{\"filter\":\"topic/test\",\"qos\":0}],\"publications\":{\"devices/42/state\":1}") {
 		t.Fatalf("unexpected content from the clients endpoint, got %s", content)
 	}
 }
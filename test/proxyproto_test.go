@@ -0,0 +1,120 @@
+package test
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"mqtt2http/broker"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+func proxyHeaderV2(ip net.IP, port uint16) []byte {
+	header := []byte("\r\n\r\n\x00\r\nQUIT\n")
+	header = append(header, 0x21, 0x11, 0x00, 12)
+	header = append(header, ip.To4()...)
+	header = append(header, 127, 0, 0, 1)
+	header = binary.BigEndian.AppendUint16(header, port)
+	header = binary.BigEndian.AppendUint16(header, 1883)
+	return header
+}
+
+func TestProxyProtocolRevealsClientAddress(t *testing.T) {
+	forwardedFor := make(chan string, 2)
+	authSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwardedFor <- r.Header.Get("X-Forwarded-For")
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer authSrv.Close()
+
+	cfg := &broker.BrokerConfig{
+		AuthorizeURL:      authSrv.URL,
+		APIPassword:       "secret",
+		ProxyProtocol:     true,
+		ProxyTrustedCIDRs: []string{"127.0.0.1/32"},
+	}
+	startBroker(t, cfg)
+
+	connect := func(clientID string, header []byte) {
+		opts := mqtt.NewClientOptions().
+			AddBroker("tcp://" + cfg.TCPAddr).
+			SetClientID(clientID).
+			SetConnectTimeout(2 * time.Second).
+			SetCustomOpenConnectionFn(func(uri *url.URL, options mqtt.ClientOptions) (net.Conn, error) {
+				conn, err := net.Dial("tcp", uri.Host)
+				if err != nil {
+					return nil, err
+				}
+				_, err = conn.Write(header)
+				return conn, err
+			})
+
+		client := mqtt.NewClient(opts)
+		if tok := client.Connect(); !tok.WaitTimeout(5*time.Second) || tok.Error() != nil {
+			t.Fatalf("connect failed: %v", tok.Error())
+		}
+		t.Cleanup(func() { client.Disconnect(250) })
+	}
+
+	connect("proxied-v1", []byte("PROXY TCP4 203.0.113.7 127.0.0.1 40000 1883\r\n"))
+	if got := <-forwardedFor; got != "203.0.113.7" {
+		t.Fatalf("unexpected X-Forwarded-For %q", got)
+	}
+
+	connect("proxied-v2", proxyHeaderV2(net.ParseIP("198.51.100.9"), 40001))
+	if got := <-forwardedFor; got != "198.51.100.9" {
+		t.Fatalf("unexpected X-Forwarded-For %q", got)
+	}
+
+	_, content := apiRequest(t, http.MethodGet, fmt.Sprintf("http://%s/clients", cfg.HTTPAddr), "secret", nil)
+	for _, addr := range []string{`"remote_addr":"203.0.113.7:40000"`, `"remote_addr":"198.51.100.9:40001"`} {
+		if !strings.Contains(string(content), addr) {
+			t.Fatalf("expected %s in the clients endpoint, got %s", addr, content)
+		}
+	}
+}
+
+func TestProxyProtocolRejectsInvalidHeaders(t *testing.T) {
+	cfg := &broker.BrokerConfig{
+		AuthorizeURL:      "http://127.0.0.1:1",
+		ProxyProtocol:     true,
+		ProxyTrustedCIDRs: []string{"127.0.0.1/32"},
+	}
+	startBroker(t, cfg)
+
+	udp := proxyHeaderV2(net.ParseIP("198.51.100.9"), 40001)
+	udp[13] = 0x12
+	unspec := proxyHeaderV2(net.ParseIP("198.51.100.9"), 40001)
+	unspec[13] = 0x00
+
+	headers := map[string][]byte{
+		"v1 without line feed": []byte("PROXY TCP4 " + strings.Repeat("1", 200)),
+		"v2 over UDP":          udp,
+		"v2 PROXY of UNSPEC":   unspec,
+	}
+	for name, header := range headers {
+		conn, err := net.Dial("tcp", cfg.TCPAddr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		if _, err := conn.Write(header); err != nil {
+			t.Fatal(err)
+		}
+
+		// The broker closes the connection well before the header timeout.
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		_, err = conn.Read(make([]byte, 1))
+		if err == nil || errors.Is(err, os.ErrDeadlineExceeded) {
+			t.Fatalf("expected the connection with %s to be closed, got %v", name, err)
+		}
+	}
+}
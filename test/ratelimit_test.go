@@ -0,0 +1,107 @@
+package test
+
+import (
+	"encoding/json"
+	"fmt"
+	"mqtt2http/broker"
+	"mqtt2http/lib"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mochi-mqtt/server/v2/packets"
+)
+
+func TestLockoutAfterFailedConnects(t *testing.T) {
+	var calls atomic.Int32
+	authSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		_, password, _ := r.BasicAuth()
+		if password != "testPassword" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer authSrv.Close()
+
+	cfg := &broker.BrokerConfig{
+		AuthorizeURL:    authSrv.URL,
+		APIPassword:     "secret",
+		AuthMaxFailures: 3,
+		AuthLockout:     time.Minute,
+		AuthMaxLockout:  time.Hour,
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("invalid config: %v", err)
+	}
+	cfg.Load()
+	startBroker(t, cfg)
+
+	for i := 0; i < 3; i++ {
+		connack := connectV5(t, cfg.TCPAddr, "guesser", "device", "wrong")
+		if connack.ReasonCode == packets.CodeSuccess.Code {
+			t.Fatal("expected connect with a wrong password to fail")
+		}
+	}
+
+	connack := connectV5(t, cfg.TCPAddr, "guesser", "device", "testPassword")
+	if connack.ReasonCode != packets.ErrConnectionRateExceeded.Code {
+		t.Fatalf("expected connection rate exceeded, got 0x%x", connack.ReasonCode)
+	}
+	if calls.Load() != 3 {
+		t.Fatalf("expected 3 authorize calls, got %d", calls.Load())
+	}
+
+	code, content := apiRequest(t, http.MethodGet, fmt.Sprintf("http://%s/lockouts", cfg.HTTPAddr), "secret", nil)
+	if code != http.StatusOK {
+		t.Fatalf("listing lockouts failed with %d: %s", code, content)
+	}
+	var lockouts []lib.Lockout
+	if err := json.Unmarshal(content, &lockouts); err != nil {
+		t.Fatal(err)
+	}
+	if len(lockouts) != 2 || lockouts[0].Kind != lib.LimitIP || lockouts[1].Key != "device" {
+		t.Fatalf("unexpected lockouts %s", content)
+	}
+
+	code, content = apiRequest(t, http.MethodDelete, fmt.Sprintf("http://%s/lockouts", cfg.HTTPAddr), "secret", nil)
+	if code != http.StatusOK || string(content) != `{"cleared":2}` {
+		t.Fatalf("clearing lockouts failed with %d: %s", code, content)
+	}
+
+	connack = connectV5(t, cfg.TCPAddr, "guesser", "device", "testPassword")
+	if connack.ReasonCode != packets.CodeSuccess.Code {
+		t.Fatalf("connect after clearing the lockouts failed with 0x%x", connack.ReasonCode)
+	}
+}
+
+func TestConnectRateLimit(t *testing.T) {
+	authSrv := createAuthSrv(t, "device", "testPassword")
+	defer authSrv.Close()
+
+	cfg := &broker.BrokerConfig{
+		AuthorizeURL:   authSrv.URL,
+		ConnectRateIP:  0.01,
+		ConnectBurstIP: 2,
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("invalid config: %v", err)
+	}
+	cfg.Load()
+	startBroker(t, cfg)
+
+	for i := 0; i < 2; i++ {
+		connack := connectV5(t, cfg.TCPAddr, fmt.Sprintf("burst-%d", i), "device", "testPassword")
+		if connack.ReasonCode != packets.CodeSuccess.Code {
+			t.Fatalf("connect %d failed with 0x%x", i, connack.ReasonCode)
+		}
+	}
+
+	connack := connectV5(t, cfg.TCPAddr, "burst-2", "device", "testPassword")
+	if connack.ReasonCode != packets.ErrConnectionRateExceeded.Code {
+		t.Fatalf("expected connection rate exceeded, got 0x%x", connack.ReasonCode)
+	}
+}
@@ -0,0 +1,134 @@
+package test
+
+import (
+	"encoding/json"
+	"fmt"
+	"mqtt2http/broker"
+	"mqtt2http/lib"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+func TestRetainedMessages(t *testing.T) {
+	authSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer authSrv.Close()
+	received := make(chan []byte, 10)
+	pubSrv := createPubSrv(t, received)
+	defer pubSrv.Close()
+
+	cfg := &broker.BrokerConfig{AuthorizeURL: authSrv.URL, PublishURL: pubSrv.URL, ContentType: "application/json", APIPassword: "secret"}
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("invalid config: %v", err)
+	}
+	cfg.Load()
+	startBroker(t, cfg)
+	base := fmt.Sprintf("http://%s/retained", cfg.HTTPAddr)
+
+	req, err := http.NewRequest(http.MethodPut, base+"/devices/42/config?qos=1&message_expiry=3600&user_property=source=api", strings.NewReader(`{"interval":10}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.SetBasicAuth("admin", "secret")
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("expected 204 when setting a retained message, got %d", resp.StatusCode)
+	}
+	select {
+	case <-received:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the retained message was not forwarded")
+	}
+
+	for _, topic := range []string{"devices/7/config", "other/config"} {
+		if code, content := apiRequest(t, http.MethodPut, base+"/"+topic, "secret", strings.NewReader("on")); code != http.StatusNoContent {
+			t.Fatalf("setting %s failed with %d: %s", topic, code, content)
+		}
+	}
+	for query, expected := range map[string]int{"/devices/%2B/config?qos=1": http.StatusBadRequest, "/devices/42/config?qos=3": http.StatusBadRequest} {
+		if code, _ := apiRequest(t, http.MethodPut, base+query, "secret", strings.NewReader("on")); code != expected {
+			t.Fatalf("expected %d for %s, got %d", expected, query, code)
+		}
+	}
+	if code, _ := apiRequest(t, http.MethodPut, base+"/devices/42/config", "secret", nil); code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for an empty payload, got %d", code)
+	}
+
+	// Subscribe after setting the messages, since mochi races when retaining
+	// a message while a subscription scans the retained messages.
+	messages := make(chan mqtt.Message, 10)
+	subscriber := connectSession(t, cfg.TCPAddr, "subscriber", "device", nil)
+	if tok := subscriber.Subscribe("devices/42/config", 1, func(_ mqtt.Client, msg mqtt.Message) { messages <- msg }); !tok.WaitTimeout(5*time.Second) || tok.Error() != nil {
+		t.Fatalf("subscribe failed: %v", tok.Error())
+	}
+	select {
+	case msg := <-messages:
+		if !msg.Retained() || string(msg.Payload()) != `{"interval":10}` {
+			t.Fatalf("unexpected retained message %q retained=%v", msg.Payload(), msg.Retained())
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the retained message was not delivered")
+	}
+
+	var retained []lib.RetainedMessage
+	code, content := apiRequest(t, http.MethodGet, base+"?filter=devices/%2B/config", "secret", nil)
+	if code != http.StatusOK {
+		t.Fatalf("listing failed with %d: %s", code, content)
+	}
+	if err := json.Unmarshal(content, &retained); err != nil {
+		t.Fatal(err)
+	}
+	if len(retained) != 2 || retained[0].Topic != "devices/42/config" || retained[1].Topic != "devices/7/config" {
+		t.Fatalf("unexpected retained messages %+v", retained)
+	}
+
+	var message lib.RetainedMessage
+	code, content = apiRequest(t, http.MethodGet, base+"/devices/42/config", "secret", nil)
+	if code != http.StatusOK {
+		t.Fatalf("fetching failed with %d: %s", code, content)
+	}
+	if err := json.Unmarshal(content, &message); err != nil {
+		t.Fatal(err)
+	}
+	if string(message.Payload) != `{"interval":10}` || message.QoS != 1 || message.ContentType != "application/json" || message.MessageExpiry != 3600 ||
+		len(message.UserProperties) != 1 || message.UserProperties[0] != (lib.UserProperty{Key: "source", Value: "api"}) {
+		t.Fatalf("unexpected retained message %+v", message)
+	}
+
+	if code, _ := apiRequest(t, http.MethodDelete, base+"/devices/42/config", "secret", nil); code != http.StatusNoContent {
+		t.Fatalf("expected 204 when deleting a retained message, got %d", code)
+	}
+	for _, method := range []string{http.MethodGet, http.MethodDelete} {
+		if code, _ := apiRequest(t, method, base+"/devices/42/config", "secret", nil); code != http.StatusNotFound {
+			t.Fatalf("expected 404 for %s of a deleted message, got %d", method, code)
+		}
+	}
+	select {
+	case msg := <-messages:
+		t.Fatalf("deleting must not publish, got %q", msg.Payload())
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	if code, _ := apiRequest(t, http.MethodDelete, base, "secret", nil); code != http.StatusBadRequest {
+		t.Fatalf("expected 400 when deleting without a filter, got %d", code)
+	}
+	code, content = apiRequest(t, http.MethodDelete, base+"?filter=%23", "secret", nil)
+	if code != http.StatusOK || string(content) != `{"deleted":2,"topics":["devices/7/config","other/config"]}` {
+		t.Fatalf("unexpected deletion of all messages %d: %s", code, content)
+	}
+	_, content = apiRequest(t, http.MethodGet, base, "secret", nil)
+	if string(content) != "[]" {
+		t.Fatalf("expected no retained message left, got %s", content)
+	}
+}
@@ -0,0 +1,136 @@
+package test
+
+import (
+	"encoding/json"
+	"fmt"
+	"mqtt2http/broker"
+	"mqtt2http/lib"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/mochi-mqtt/server/v2/packets"
+)
+
+// connectSession connects a client that stays connected until the end of
+// the test and reports on lost when the broker disconnects it.
+func connectSession(t *testing.T, addr string, clientID string, username string, lost chan<- string) mqtt.Client {
+	t.Helper()
+
+	opts := mqtt.NewClientOptions().
+		AddBroker("tcp://" + addr).
+		SetClientID(clientID).
+		SetUsername(username).
+		SetPassword("testPassword").
+		SetProtocolVersion(4).
+		SetAutoReconnect(false).
+		SetConnectTimeout(2 * time.Second).
+		SetConnectionLostHandler(func(client mqtt.Client, err error) {
+			if lost != nil {
+				lost <- clientID
+			}
+		})
+
+	client := mqtt.NewClient(opts)
+	tok := client.Connect()
+	if !tok.WaitTimeout(5*time.Second) || tok.Error() != nil {
+		t.Fatalf("connect of %s failed: %v", clientID, tok.Error())
+	}
+	t.Cleanup(func() { client.Disconnect(250) })
+	return client
+}
+
+func TestMaxSessionsPerUsername(t *testing.T) {
+	authSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		username, _, _ := r.BasicAuth()
+		if username == "shared" {
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"max_sessions": 2}`))
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer authSrv.Close()
+
+	cfg := &broker.BrokerConfig{AuthorizeURL: authSrv.URL, MaxSessions: 1}
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("invalid config: %v", err)
+	}
+	cfg.Load()
+	startBroker(t, cfg)
+
+	connectSession(t, cfg.TCPAddr, "device-1", "device", nil)
+	if connack := connectV5(t, cfg.TCPAddr, "device-2", "device", "testPassword"); connack.ReasonCode != packets.ErrQuotaExceeded.Code {
+		t.Fatalf("expected quota exceeded, got 0x%x", connack.ReasonCode)
+	}
+
+	connectSession(t, cfg.TCPAddr, "shared-1", "shared", nil)
+	connectSession(t, cfg.TCPAddr, "shared-2", "shared", nil)
+	if connack := connectV5(t, cfg.TCPAddr, "shared-3", "shared", "testPassword"); connack.ReasonCode != packets.ErrQuotaExceeded.Code {
+		t.Fatalf("expected quota exceeded, got 0x%x", connack.ReasonCode)
+	}
+}
+
+func TestKickOldestSessionAndTakeover(t *testing.T) {
+	authSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer authSrv.Close()
+
+	cfg := &broker.BrokerConfig{
+		AuthorizeURL:     authSrv.URL,
+		APIPassword:      "secret",
+		MaxSessions:      1,
+		SessionPolicy:    lib.SessionLimitKickOldest,
+		ClientIDTakeover: lib.TakeoverSameUsername,
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("invalid config: %v", err)
+	}
+	cfg.Load()
+	startBroker(t, cfg)
+
+	lost := make(chan string, 2)
+	connectSession(t, cfg.TCPAddr, "old", "device", lost)
+	connectSession(t, cfg.TCPAddr, "new", "device", lost)
+
+	select {
+	case id := <-lost:
+		if id != "old" {
+			t.Fatalf("expected the oldest session to be disconnected, %s was", id)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("oldest session was not disconnected")
+	}
+
+	if connack := connectV5(t, cfg.TCPAddr, "new", "intruder", "testPassword"); connack.ReasonCode != packets.ErrClientIdentifierNotValid.Code {
+		t.Fatalf("expected client identifier not valid, got 0x%x", connack.ReasonCode)
+	}
+	select {
+	case id := <-lost:
+		t.Fatalf("session %s was disconnected by a refused takeover", id)
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	connectSession(t, cfg.TCPAddr, "new", "device", nil)
+	select {
+	case id := <-lost:
+		if id != "new" {
+			t.Fatalf("expected the taken over session to be disconnected, %s was", id)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("taken over session was not disconnected")
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	code, content := apiRequest(t, http.MethodGet, fmt.Sprintf("http://%s/clients", cfg.HTTPAddr), "secret", nil)
+	var clients []lib.Client
+	if err := json.Unmarshal(content, &clients); code != http.StatusOK || err != nil {
+		t.Fatalf("listing clients failed with %d: %s", code, content)
+	}
+	if len(clients) != 1 || clients[0].ID != "new" {
+		t.Fatalf("expected the session taking over to be listed, got %s", content)
+	}
+}
@@ -0,0 +1,180 @@
+package test
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"mqtt2http/broker"
+	"mqtt2http/lib"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/mochi-mqtt/server/v2/packets"
+)
+
+func TestSessionSettingsFromAuthorizeResponse(t *testing.T) {
+	authSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{
+			"client_id": "tenant-a-1",
+			"topic_prefix": "tenant-a/",
+			"max_keepalive": 10,
+			"receive_maximum": 5,
+			"max_packet_size": 4096,
+			"max_qos": 1,
+			"retain": false
+		}`))
+	}))
+	defer authSrv.Close()
+
+	forwarded := make(chan string, 1)
+	pubSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwarded <- r.URL.Path
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer pubSrv.Close()
+
+	cfg := &broker.BrokerConfig{AuthorizeURL: authSrv.URL, APIPassword: "secret"}
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("invalid config: %v", err)
+	}
+	cfg.Load()
+	cfg.Routes = []lib.Route{{Name: "all", Pattern: ".*", URL: pubSrv.URL + "/{topic}"}}
+	startBroker(t, cfg)
+
+	connack := connectV5(t, cfg.TCPAddr, "sensor", "device", "testPassword")
+	props := connack.Properties
+	if connack.ReasonCode != packets.CodeSuccess.Code || props.AssignedClientID != "tenant-a-1" || props.ServerKeepAlive != 10 ||
+		props.ReceiveMaximum != 5 || props.MaximumPacketSize != 4096 || props.MaximumQos != 1 || !props.RetainAvailableFlag {
+		t.Fatalf("unexpected CONNACK 0x%x %+v", connack.ReasonCode, props)
+	}
+
+	opts := mqtt.NewClientOptions().
+		AddBroker("tcp://" + cfg.TCPAddr).
+		SetClientID("sensor").
+		SetUsername("device").
+		SetPassword("testPassword").
+		SetProtocolVersion(4).
+		SetConnectTimeout(2 * time.Second)
+	client := mqtt.NewClient(opts)
+	if tok := client.Connect(); !tok.WaitTimeout(5*time.Second) || tok.Error() != nil {
+		t.Fatalf("connect failed: %v", tok.Error())
+	}
+	defer client.Disconnect(250)
+
+	received := make(chan string, 1)
+	tok := client.Subscribe("state/#", 1, func(c mqtt.Client, m mqtt.Message) {
+		received <- m.Topic()
+	})
+	if !tok.WaitTimeout(5*time.Second) || tok.Error() != nil {
+		t.Fatalf("subscribe failed: %v", tok.Error())
+	}
+	if tok := client.Publish("state/door", 1, false, []byte("open")); !tok.WaitTimeout(5*time.Second) || tok.Error() != nil {
+		t.Fatalf("publish failed: %v", tok.Error())
+	}
+
+	select {
+	case path := <-forwarded:
+		if path != "/tenant-a/state/door" {
+			t.Fatalf("expected the prefixed topic to be forwarded, got %s", path)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("timed out waiting for forwarded request")
+	}
+	select {
+	case topic := <-received:
+		if topic != "state/door" {
+			t.Fatalf("expected the topic without prefix, got %s", topic)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("timed out waiting for message")
+	}
+
+	code, content := apiRequest(t, http.MethodGet, fmt.Sprintf("http://%s/clients", cfg.HTTPAddr), "secret", nil)
+	var clients []lib.Client
+	if err := json.Unmarshal(content, &clients); code != http.StatusOK || err != nil {
+		t.Fatalf("listing clients failed with %d: %s", code, content)
+	}
+	if len(clients) != 1 || clients[0].ID != "tenant-a-1" || clients[0].Subscribtions[0].Filter != "tenant-a/state/#" {
+		t.Fatalf("unexpected clients %s", content)
+	}
+}
+
+func TestPacketsLargerThanMaxPacketSizeAreRejected(t *testing.T) {
+	authSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"max_packet_size": 64}`))
+	}))
+	defer authSrv.Close()
+
+	forwarded := make(chan string, 4)
+	pubSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwarded <- r.URL.Path
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer pubSrv.Close()
+
+	cfg := &broker.BrokerConfig{AuthorizeURL: authSrv.URL}
+	cfg.Load()
+	cfg.Routes = []lib.Route{{Name: "all", Pattern: ".*", URL: pubSrv.URL + "/{topic}"}}
+	startBroker(t, cfg)
+
+	// 60 bytes of payload take the packet over the limit with the topic.
+	payload := bytes.Repeat([]byte("x"), 60)
+
+	conn, reader, _ := dialV5(t, cfg.TCPAddr, "sensor-v5", "device", "testPassword")
+	publish := packets.Packet{
+		FixedHeader:     packets.FixedHeader{Type: packets.Publish},
+		ProtocolVersion: 5,
+		TopicName:       "state/v5",
+		Payload:         payload,
+	}
+	buf := new(bytes.Buffer)
+	if err := publish.PublishEncode(buf); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Write(buf.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	disconnect := readPacketV5(t, reader)
+	if disconnect.FixedHeader.Type != packets.Disconnect || len(disconnect.Payload) == 0 || disconnect.Payload[0] != packets.ErrPacketTooLarge.Code {
+		t.Fatalf("expected DISCONNECT 0x%x, got type %d %v", packets.ErrPacketTooLarge.Code, disconnect.FixedHeader.Type, disconnect.Payload)
+	}
+	if _, err := reader.ReadByte(); err == nil {
+		t.Fatal("expected the MQTT 5 connection to be closed")
+	}
+
+	lost := make(chan error, 1)
+	opts := mqtt.NewClientOptions().
+		AddBroker("tcp://" + cfg.TCPAddr).
+		SetClientID("sensor-v3").
+		SetUsername("device").
+		SetPassword("testPassword").
+		SetProtocolVersion(4).
+		SetAutoReconnect(false).
+		SetConnectTimeout(2 * time.Second).
+		SetConnectionLostHandler(func(c mqtt.Client, err error) {
+			lost <- err
+		})
+	client := mqtt.NewClient(opts)
+	if tok := client.Connect(); !tok.WaitTimeout(5*time.Second) || tok.Error() != nil {
+		t.Fatalf("connect failed: %v", tok.Error())
+	}
+	defer client.Disconnect(250)
+
+	client.Publish("state/v3", 0, false, payload)
+	select {
+	case <-lost:
+	case <-time.After(3 * time.Second):
+		t.Fatal("expected the MQTT 3.1.1 connection to be closed")
+	}
+
+	select {
+	case path := <-forwarded:
+		t.Fatalf("expected the oversized packets not to be forwarded, got %s", path)
+	case <-time.After(500 * time.Millisecond):
+	}
+}
@@ -0,0 +1,150 @@
+package test
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"mqtt2http/broker"
+	"mqtt2http/lib"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/mochi-mqtt/server/v2/packets"
+)
+
+// sendV5 encodes and writes an MQTT 5 packet.
+func sendV5(t *testing.T, conn net.Conn, pk packets.Packet) {
+	t.Helper()
+
+	pk.ProtocolVersion = 5
+	buf := new(bytes.Buffer)
+	var err error
+	switch pk.FixedHeader.Type {
+	case packets.Subscribe:
+		err = pk.SubscribeEncode(buf)
+	case packets.Unsubscribe:
+		err = pk.UnsubscribeEncode(buf)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Write(buf.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func clientSubscriptions(t *testing.T, addr string, id string) []lib.Subscription {
+	t.Helper()
+
+	code, content := apiRequest(t, http.MethodGet, fmt.Sprintf("http://%s/clients/%s", addr, id), "secret", nil)
+	if code != http.StatusOK {
+		t.Fatalf("client details failed with %d: %s", code, content)
+	}
+	var details lib.ClientDetails
+	if err := json.Unmarshal(content, &details); err != nil {
+		t.Fatal(err)
+	}
+	return details.Subscribtions
+}
+
+func TestSubscriptionTracking(t *testing.T) {
+	authSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"subscribe": ["sensors/#", "$share/workers/jobs"], "max_qos": 1}`))
+	}))
+	defer authSrv.Close()
+
+	cfg := &broker.BrokerConfig{AuthorizeURL: authSrv.URL, APIPassword: "secret"}
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("invalid config: %v", err)
+	}
+	cfg.Load()
+	startBroker(t, cfg)
+
+	conn, reader, connack := dialV5(t, cfg.TCPAddr, "watcher", "device", "testPassword")
+	if connack.ReasonCode != packets.CodeSuccess.Code {
+		t.Fatalf("connect failed with 0x%x", connack.ReasonCode)
+	}
+
+	sendV5(t, conn, packets.Packet{
+		FixedHeader: packets.FixedHeader{Type: packets.Subscribe, Qos: 1},
+		PacketID:    1,
+		Filters: packets.Subscriptions{
+			{Filter: "sensors/+/temp", Qos: 2, NoLocal: true, RetainAsPublished: true, RetainHandling: 1},
+			{Filter: "$share/workers/jobs", Qos: 1},
+			{Filter: "admin/#", Qos: 0},
+		},
+	})
+	suback := readPacketV5(t, reader)
+	if err := suback.SubackDecode(suback.Payload); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(suback.ReasonCodes, []byte{1, 1, packets.ErrNotAuthorized.Code}) {
+		t.Fatalf("unexpected SUBACK codes %v", suback.ReasonCodes)
+	}
+
+	subs := clientSubscriptions(t, cfg.HTTPAddr, "watcher")
+	expected := []lib.Subscription{
+		{Filter: "sensors/+/temp", QoS: 1, NoLocal: true, RetainAsPublished: true, RetainHandling: 1},
+		{Filter: "$share/workers/jobs", QoS: 1, Group: "workers"},
+	}
+	if fmt.Sprint(subs) != fmt.Sprint(expected) {
+		t.Fatalf("expected subscriptions %+v, got %+v", expected, subs)
+	}
+
+	sendV5(t, conn, packets.Packet{
+		FixedHeader: packets.FixedHeader{Type: packets.Unsubscribe, Qos: 1},
+		PacketID:    2,
+		Filters:     packets.Subscriptions{{Filter: "sensors/+/temp"}},
+	})
+	if unsuback := readPacketV5(t, reader); unsuback.FixedHeader.Type != packets.Unsuback {
+		t.Fatalf("expected UNSUBACK, got packet type %d", unsuback.FixedHeader.Type)
+	}
+
+	subs = clientSubscriptions(t, cfg.HTTPAddr, "watcher")
+	if len(subs) != 1 || subs[0].Filter != "$share/workers/jobs" {
+		t.Fatalf("expected the shared subscription only, got %+v", subs)
+	}
+}
+
+func TestResumedSessionSubscriptions(t *testing.T) {
+	authSrv := createAuthSrv(t, "device", "testPassword")
+	defer authSrv.Close()
+
+	cfg := &broker.BrokerConfig{AuthorizeURL: authSrv.URL, APIPassword: "secret"}
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("invalid config: %v", err)
+	}
+	cfg.Load()
+	startBroker(t, cfg)
+
+	opts := mqtt.NewClientOptions().
+		AddBroker("tcp://" + cfg.TCPAddr).
+		SetClientID("resumer").
+		SetUsername("device").
+		SetPassword("testPassword").
+		SetCleanSession(false)
+	client := mqtt.NewClient(opts)
+	if tok := client.Connect(); !tok.WaitTimeout(5*time.Second) || tok.Error() != nil {
+		t.Fatalf("connect failed: %v", tok.Error())
+	}
+	if tok := client.Subscribe("alerts/#", 1, nil); !tok.WaitTimeout(5*time.Second) || tok.Error() != nil {
+		t.Fatalf("subscribe failed: %v", tok.Error())
+	}
+	client.Disconnect(250)
+
+	client = mqtt.NewClient(opts)
+	if tok := client.Connect(); !tok.WaitTimeout(5*time.Second) || tok.Error() != nil {
+		t.Fatalf("reconnect failed: %v", tok.Error())
+	}
+	defer client.Disconnect(250)
+
+	subs := clientSubscriptions(t, cfg.HTTPAddr, "resumer")
+	if len(subs) != 1 || subs[0].Filter != "alerts/#" || subs[0].QoS != 1 {
+		t.Fatalf("expected the subscription of the resumed session, got %+v", subs)
+	}
+}
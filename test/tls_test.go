@@ -0,0 +1,146 @@
+package test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"mqtt2http/broker"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+type testCertificate struct {
+	cert     *x509.Certificate
+	key      *ecdsa.PrivateKey
+	certPath string
+	keyPath  string
+}
+
+// createCertificate writes a PEM certificate and key signed by parent, or
+// self-signed when parent is nil.
+func createCertificate(t *testing.T, dir string, name string, parent *testCertificate, isCA bool) *testCertificate {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		BasicConstraintsValid: true,
+		IsCA:                  isCA,
+	}
+
+	parentCert, parentKey := template, key
+	if parent != nil {
+		parentCert, parentKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parentCert, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certPath := filepath.Join(dir, name+".crt")
+	keyPath := filepath.Join(dir, name+".key")
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+	if err := os.WriteFile(certPath, certPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyPath, keyPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	return &testCertificate{cert: cert, key: key, certPath: certPath, keyPath: keyPath}
+}
+
+func TestMutualTLSListener(t *testing.T) {
+	dir := t.TempDir()
+	ca := createCertificate(t, dir, "ca", nil, true)
+	server := createCertificate(t, dir, "server", ca, false)
+	device := createCertificate(t, dir, "device", ca, false)
+
+	clientUsername := "testClient"
+	clientPassword := "testPassword"
+
+	authSrv := createAuthSrv(t, clientUsername, clientPassword)
+	defer authSrv.Close()
+
+	tlsAddr := freePortAddr(t)
+	cfg := &broker.BrokerConfig{
+		AuthorizeURL:    authSrv.URL,
+		TLSAddr:         tlsAddr,
+		TLSCertFile:     server.certPath,
+		TLSKeyFile:      server.keyPath,
+		TLSClientCAFile: ca.certPath,
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("invalid config: %v", err)
+	}
+	startBroker(t, cfg)
+	waitForTCP(t, tlsAddr, 5*time.Second)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+
+	connect := func(certificates []tls.Certificate) error {
+		opts := mqtt.NewClientOptions().
+			AddBroker("ssl://" + tlsAddr).
+			SetClientID("tls-test").
+			SetUsername(clientUsername).
+			SetPassword(clientPassword).
+			SetConnectTimeout(2 * time.Second).
+			SetTLSConfig(&tls.Config{RootCAs: roots, Certificates: certificates})
+
+		client := mqtt.NewClient(opts)
+		tok := client.Connect()
+		if !tok.WaitTimeout(5 * time.Second) {
+			t.Fatal("connect timed out")
+		}
+		if tok.Error() == nil {
+			client.Disconnect(250)
+		}
+		return tok.Error()
+	}
+
+	if err := connect(nil); err == nil {
+		t.Fatal("expected connection without client certificate to fail")
+	}
+
+	pair, err := tls.LoadX509KeyPair(device.certPath, device.keyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := connect([]tls.Certificate{pair}); err != nil {
+		t.Fatalf("connect with client certificate failed: %v", err)
+	}
+}
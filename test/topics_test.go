@@ -0,0 +1,94 @@
+package test
+
+import (
+	"encoding/json"
+	"fmt"
+	"mqtt2http/broker"
+	"mqtt2http/lib"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestSubscriptionsAndTopics(t *testing.T) {
+	authSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer authSrv.Close()
+	pubSrv := createPubSrv(t, make(chan []byte, 10))
+	defer pubSrv.Close()
+
+	cfg := &broker.BrokerConfig{AuthorizeURL: authSrv.URL, PublishURL: pubSrv.URL, ContentType: "application/json", APIPassword: "secret"}
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("invalid config: %v", err)
+	}
+	cfg.Load()
+	startBroker(t, cfg)
+
+	// Publish first, since mochi races when retaining a message while a
+	// subscription scans the retained messages.
+	publisher := connectSession(t, cfg.TCPAddr, "publisher", "device", nil)
+	for _, topic := range []string{"devices/42/cmd", "devices/42/cmd", "devices/7/state"} {
+		if tok := publisher.Publish(topic, 1, topic == "devices/42/cmd", "on"); !tok.WaitTimeout(5*time.Second) || tok.Error() != nil {
+			t.Fatalf("publish failed: %v", tok.Error())
+		}
+	}
+	for id, filter := range map[string]string{"sub-1": "devices/+/cmd", "sub-2": "$share/workers/devices/42/cmd", "sub-3": "other/#"} {
+		client := connectSession(t, cfg.TCPAddr, id, "device", nil)
+		if tok := client.Subscribe(filter, 1, nil); !tok.WaitTimeout(5*time.Second) || tok.Error() != nil {
+			t.Fatalf("subscribe failed: %v", tok.Error())
+		}
+	}
+
+	get := func(path string, v any) {
+		t.Helper()
+		code, content := apiRequest(t, http.MethodGet, fmt.Sprintf("http://%s%s", cfg.HTTPAddr, path), "secret", nil)
+		if code != http.StatusOK {
+			t.Fatalf("%s failed with %d: %s", path, code, content)
+		}
+		if err := json.Unmarshal(content, v); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var subs []lib.ClientSubscription
+	get("/subscriptions?filter=devices/42/cmd", &subs)
+	if len(subs) != 2 || subs[0].ClientID != "sub-1" || subs[1].ClientID != "sub-2" || subs[1].Group != "workers" || !subs[0].Connected {
+		t.Fatalf("unexpected subscribers of the topic %+v", subs)
+	}
+	get("/subscriptions?filter=devices/%2B/cmd", &subs)
+	if len(subs) != 2 || subs[0].ClientID != "sub-1" || subs[1].ClientID != "sub-2" {
+		t.Fatalf("unexpected subscriptions overlapping the filter %+v", subs)
+	}
+	get("/subscriptions?filter=devices/%23", &subs)
+	if len(subs) != 2 || subs[0].Filter != "devices/+/cmd" || subs[1].Filter != "$share/workers/devices/42/cmd" {
+		t.Fatalf("expected the narrower subscriptions under the filter, got %+v", subs)
+	}
+	get("/subscriptions?filter=other/%2B/state", &subs)
+	if len(subs) != 1 || subs[0].ClientID != "sub-3" {
+		t.Fatalf("expected the wider subscription over the filter, got %+v", subs)
+	}
+	get("/subscriptions", &subs)
+	if len(subs) != 3 {
+		t.Fatalf("expected all 3 subscriptions, got %+v", subs)
+	}
+
+	var topics []lib.TopicActivity
+	get("/topics", &topics)
+	if len(topics) != 2 {
+		t.Fatalf("expected 2 topics, got %+v", topics)
+	}
+	cmd, state := topics[0], topics[1]
+	if cmd.Topic != "devices/42/cmd" || cmd.Messages != 2 || cmd.Subscribers != 2 || !cmd.Retained || cmd.LastPublish == nil || cmd.Rate <= 0 {
+		t.Fatalf("unexpected activity of the command topic %+v", cmd)
+	}
+	if state.Topic != "devices/7/state" || state.Messages != 1 || state.Subscribers != 0 || state.Retained {
+		t.Fatalf("unexpected activity of the state topic %+v", state)
+	}
+
+	get("/topics?filter=devices/%2B/state", &topics)
+	if len(topics) != 1 || topics[0].Topic != "devices/7/state" {
+		t.Fatalf("unexpected filtered topics %+v", topics)
+	}
+}
@@ -0,0 +1,118 @@
+package test
+
+import (
+	"mqtt2http/broker"
+	"mqtt2http/lib"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+func TestUsersFileAuthentication(t *testing.T) {
+	received := make(chan []byte, 3)
+
+	authSrv := createAuthSrv(t, "remote", "testPassword")
+	defer authSrv.Close()
+
+	pubSrv := createPubSrv(t, received)
+	defer pubSrv.Close()
+
+	dir := t.TempDir()
+	usersPath := filepath.Join(dir, "users")
+	setUser := func(username string, password string, algorithm string, groups ...string) {
+		hash, err := lib.HashPassword(password, algorithm)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := lib.SetUser(usersPath, lib.User{Username: username, Hash: hash, Groups: groups}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	setUser("alice", "alicePassword", lib.HashBcrypt, "sensors")
+	setUser("bob", "bobPassword", lib.HashArgon2id)
+
+	aclPath := filepath.Join(dir, "acl.yaml")
+	err := os.WriteFile(aclPath, []byte(`
+default: deny
+rules:
+  - permission: allow
+    group: sensors
+    topics: ['sensors/#']
+`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := &broker.BrokerConfig{
+		AuthorizeURL:  authSrv.URL,
+		PublishURL:    pubSrv.URL,
+		ContentType:   "application/json",
+		UsersFilePath: usersPath,
+		ACLFilePath:   aclPath,
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("invalid config: %v", err)
+	}
+	cfg.Load()
+	b := startBroker(t, cfg)
+
+	connect := func(username string, password string) (mqtt.Client, error) {
+		opts := mqtt.NewClientOptions().
+			AddBroker("tcp://" + cfg.TCPAddr).
+			SetClientID("users-" + username).
+			SetUsername(username).
+			SetPassword(password).
+			SetProtocolVersion(4).
+			// Password hashing is slow under the race detector.
+			SetConnectTimeout(10 * time.Second)
+
+		client := mqtt.NewClient(opts)
+		tok := client.Connect()
+		if !tok.WaitTimeout(15 * time.Second) {
+			t.Fatal("connect timed out")
+		}
+		if tok.Error() == nil {
+			t.Cleanup(func() { client.Disconnect(250) })
+		}
+		return client, tok.Error()
+	}
+
+	alice, err := connect("alice", "alicePassword")
+	if err != nil {
+		t.Fatalf("connect with a bcrypt password failed: %v", err)
+	}
+	if _, err := connect("bob", "bobPassword"); err != nil {
+		t.Fatalf("connect with an argon2id password failed: %v", err)
+	}
+	if _, err := connect("alice", "wrong"); err == nil {
+		t.Fatal("expected connect with a wrong password to fail")
+	}
+	if _, err := connect("remote", "testPassword"); err != nil {
+		t.Fatalf("connect of a user unknown to the file failed: %v", err)
+	}
+
+	if tok := alice.Publish("sensors/temperature", 0, false, []byte("21")); !tok.WaitTimeout(5*time.Second) || tok.Error() != nil {
+		t.Fatalf("publish failed: %v", tok.Error())
+	}
+	select {
+	case got := <-received:
+		if string(got) != "21" {
+			t.Fatalf("unexpected forwarded body %s", got)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("timed out waiting for the message allowed by the group rule")
+	}
+
+	setUser("bob", "newPassword", lib.HashBcrypt)
+	b.Reload()
+
+	if _, err := connect("bob", "bobPassword"); err == nil {
+		t.Fatal("expected connect with the old password to fail after reload")
+	}
+	if _, err := connect("bob", "newPassword"); err != nil {
+		t.Fatalf("connect with the new password failed: %v", err)
+	}
+}
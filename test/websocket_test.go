@@ -0,0 +1,67 @@
+package test
+
+import (
+	"fmt"
+	"mqtt2http/broker"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+func TestWebsocketClientIsAuthenticatedAndListed(t *testing.T) {
+	clientUsername := "testClient"
+	clientPassword := "testPassword"
+
+	authSrv := createAuthSrv(t, clientUsername, clientPassword)
+	defer authSrv.Close()
+
+	wsAddr := freePortAddr(t)
+	cfg := &broker.BrokerConfig{
+		AuthorizeURL:     authSrv.URL,
+		APIPassword:      "secret",
+		WSAddr:           wsAddr,
+		WSPath:           "/mqtt",
+		WSAllowedOrigins: []string{"https://dashboard.example.com"},
+	}
+	startBroker(t, cfg)
+	waitForTCP(t, wsAddr, 5*time.Second)
+
+	connect := func(clientID string, origin string) (mqtt.Client, error) {
+		opts := mqtt.NewClientOptions().
+			AddBroker("ws://" + wsAddr + "/mqtt").
+			SetClientID(clientID).
+			SetUsername(clientUsername).
+			SetPassword(clientPassword).
+			SetConnectTimeout(2 * time.Second).
+			SetHTTPHeaders(http.Header{"Origin": []string{origin}})
+
+		client := mqtt.NewClient(opts)
+		tok := client.Connect()
+		if !tok.WaitTimeout(5 * time.Second) {
+			t.Fatal("connect timed out")
+		}
+		return client, tok.Error()
+	}
+
+	if _, err := connect("ws-evil", "https://evil.example.com"); err == nil {
+		t.Fatal("expected connection from a disallowed origin to fail")
+	}
+
+	client, err := connect("ws-test", "https://dashboard.example.com")
+	if err != nil {
+		t.Fatalf("connect failed: %v", err)
+	}
+	t.Cleanup(func() { client.Disconnect(250) })
+
+	url := fmt.Sprintf("http://%s/clients", cfg.HTTPAddr)
+	code, content := apiRequest(t, http.MethodGet, url, "secret", nil)
+	if code != http.StatusOK {
+		t.Fatalf("unexpected status %d", code)
+	}
+	if !strings.Contains(string(content), `"id":"ws-test"`) {
+		t.Fatalf("websocket client missing from the clients endpoint, got %s", content)
+	}
+}